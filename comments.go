@@ -0,0 +1,147 @@
+package celplate
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Comments define which parts of the input are comments. Comments are copied
+// to the output as they are, without evaluating expressions inside of them.
+type Comments struct {
+	// Line are the prefixes of comments running until the end of the line,
+	// e.g. "#" or "//". Unless Inline is set, only lines starting with them,
+	// ignoring leading whitespace, are comments.
+	Line []string
+
+	// Block are the comments which can start anywhere in the input and span
+	// multiple lines, e.g. /* ... */.
+	Block []BlockComment
+
+	// Inline makes line comments also start after other content on the line,
+	// as long as they are preceded by whitespace, e.g. "key: value # comment".
+	// Unless their quotes are listed in Quotes, quoted strings are not
+	// recognised, so "key: 'a # b'" has a comment too.
+	Inline bool
+
+	// Quotes are the characters delimiting strings, inside of which comments
+	// are not recognised, e.g. `"` for "arn:aws:s3:::bucket/*". A backslash
+	// escapes the following character, and strings end with their lines.
+	Quotes string
+
+	// YAMLBlockScalars makes the contents of YAML block scalars (| and >)
+	// exempt from comment detection, since they can contain any text.
+	YAMLBlockScalars bool
+}
+
+// BlockComment is a comment delimited by an opening and a closing sequence.
+type BlockComment struct {
+	Open  string
+	Close string
+}
+
+var (
+	// DefaultComments are the comments recognised by the scanner unless
+	// configured otherwise: lines starting with a hash (#).
+	DefaultComments = Comments{Line: []string{"#"}}
+
+	// NoComments disables comment detection, so all expressions are
+	// evaluated, e.g. in JSON files.
+	NoComments = Comments{}
+
+	// YAMLComments are the comments of YAML files.
+	YAMLComments = Comments{Line: []string{"#"}, Inline: true, YAMLBlockScalars: true}
+
+	// HCLComments are the comments of HCL (e.g. Terraform) files.
+	HCLComments = Comments{Line: []string{"#", "//"}, Block: []BlockComment{{Open: "/*", Close: "*/"}}, Inline: true, Quotes: `"`}
+
+	// SQLComments are the comments of SQL files.
+	SQLComments = Comments{Line: []string{"--"}, Block: []BlockComment{{Open: "/*", Close: "*/"}}, Inline: true, Quotes: `'"`}
+
+	// ShellComments are the comments of shell scripts.
+	ShellComments = Comments{Line: []string{"#"}, Inline: true}
+)
+
+// yamlBlockScalarPattern matches lines ending with a YAML block scalar
+// indicator, like "key: |", "- >-" or "key: |2 # comment".
+var yamlBlockScalarPattern = regexp.MustCompile(`(?:^\s*|:\s+|-\s+)[|>][-+0-9]{0,2}\s*(?:#.*)?$`)
+
+// WithComments makes the scanner recognise the given comments instead of the
+// DefaultComments.
+func WithComments(comments Comments) Option {
+	return func(s *Scanner) {
+		s.comments = comments
+	}
+}
+
+func (c Comments) validate() error {
+	for _, prefix := range c.Line {
+		if prefix == "" || strings.ContainsRune(prefix, '\n') {
+			return errors.New("line comment prefixes must not be empty nor contain line breaks")
+		}
+	}
+
+	for _, block := range c.Block {
+		if block.Open == "" || block.Close == "" || strings.ContainsRune(block.Open+block.Close, '\n') {
+			return errors.New("block comment delimiters must not be empty nor contain line breaks")
+		}
+	}
+
+	return nil
+}
+
+// lineCommentAt returns whether a line comment starts at the given byte index
+// of the line. The content flag tells whether anything but whitespace
+// precedes the index on the line.
+func (c Comments) lineCommentAt(line string, index int, content bool) bool {
+	if len(c.Line) == 0 {
+		return false
+	}
+
+	if content && (!c.Inline || !endsWithSpace(line[:index])) {
+		return false
+	}
+
+	for _, prefix := range c.Line {
+		if strings.HasPrefix(line[index:], prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blockCommentAt returns the block comment starting at the given byte index
+// of the line, if any.
+func (c Comments) blockCommentAt(line string, index int) (BlockComment, bool) {
+	for _, block := range c.Block {
+		if strings.HasPrefix(line[index:], block.Open) {
+			return block, true
+		}
+	}
+
+	return BlockComment{}, false
+}
+
+// opensYAMLBlockScalar returns whether the contents of a YAML block scalar
+// start after the given line.
+func opensYAMLBlockScalar(line string) bool {
+	// Most lines have no indicator at all, so the pattern is not needed.
+	if !strings.ContainsAny(line, "|>") {
+		return false
+	}
+
+	return yamlBlockScalarPattern.MatchString(strings.TrimRightFunc(line, unicode.IsSpace))
+}
+
+// indentation returns the number of leading whitespace characters of the
+// line, or -1 if the line is blank.
+func indentation(line string) int {
+	trimmed := strings.TrimLeftFunc(line, unicode.IsSpace)
+	if trimmed == "" {
+		return -1
+	}
+
+	return len(line) - len(trimmed)
+}
@@ -0,0 +1,185 @@
+package celplate_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+)
+
+func TestScanner_Transform_Comments(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments celplate.Comments
+		input    string
+		want     string
+	}{
+		{
+			name:     "default comments",
+			comments: celplate.DefaultComments,
+			input:    "  # ${{ x }}\nkey: ${{ x }} # ${{ x }}",
+			want:     "  # ${{ x }}\nkey: x # x",
+		},
+		{
+			name:     "no comments",
+			comments: celplate.NoComments,
+			input:    "# ${{ x }}\n// ${{ x }}",
+			want:     "# x\n// x",
+		},
+		{
+			name:     "inline comments",
+			comments: celplate.ShellComments,
+			input:    "echo ${{ x }} # ${{ x }}\necho ${{ x }}#${{ x }}",
+			want:     "echo x # ${{ x }}\necho x#x",
+		},
+		{
+			name:     "HCL comments",
+			comments: celplate.HCLComments,
+			input:    "// ${{ x }}\n# ${{ x }}\na = ${{ x }} // ${{ x }}\nb = \"http://${{ x }}\"",
+			want:     "// ${{ x }}\n# ${{ x }}\na = x // ${{ x }}\nb = \"http://x\"",
+		},
+		{
+			name:     "block comments",
+			comments: celplate.HCLComments,
+			input:    "a = ${{ x }} /* ${{ x }}\n${{ x }} */ ${{ x }} /**/ ${{ x }}",
+			want:     "a = x /* ${{ x }}\n${{ x }} */ x /**/ x",
+		},
+		{
+			name:     "comment openers inside strings",
+			comments: celplate.HCLComments,
+			input:    "resource = \"arn:aws:s3:::bucket/*\"\nname = \"${{ x }}/* \\\" // #\" # ${{ x }}\nurl = ${{ x }}",
+			want:     "resource = \"arn:aws:s3:::bucket/*\"\nname = \"x/* \\\" // #\" # ${{ x }}\nurl = x",
+		},
+		{
+			name:     "unterminated string",
+			comments: celplate.SQLComments,
+			input:    "SELECT 'it -- ${{ x }}\nSELECT ${{ x }} -- ${{ x }}",
+			want:     "SELECT 'it -- x\nSELECT x -- ${{ x }}",
+		},
+		{
+			name:     "SQL comments",
+			comments: celplate.SQLComments,
+			input:    "-- ${{ x }}\nSELECT ${{ x }} -- ${{ x }}\n# ${{ x }}",
+			want:     "-- ${{ x }}\nSELECT x -- ${{ x }}\n# x",
+		},
+		{
+			name:     "comment prefix inside an expression",
+			comments: celplate.HCLComments,
+			input:    "a = ${{ x + '//' }} # ${{ x }}",
+			want:     "a = x// # ${{ x }}",
+		},
+		{
+			name:     "YAML block scalars",
+			comments: celplate.YAMLComments,
+			input: `# ${{ x }}
+script: |
+  #!/bin/sh
+  # ${{ x }}
+
+  echo ${{ x }} # ${{ x }}
+folded: >-
+    # ${{ x }}
+list:
+  - |+
+    # ${{ x }}
+  # ${{ x }}
+key: value # ${{ x }}`,
+			want: `# ${{ x }}
+script: |
+  #!/bin/sh
+  # x
+
+  echo x # x
+folded: >-
+    # x
+list:
+  - |+
+    # x
+  # ${{ x }}
+key: value # ${{ x }}`,
+		},
+		{
+			name:     "block scalar indicators in comments",
+			comments: celplate.YAMLComments,
+			input:    "# example: |\n  # ${{ x }}\nkey: ${{ x }}",
+			want:     "# example: |\n  # ${{ x }}\nkey: x",
+		},
+		{
+			name:     "pipes are not YAML block scalars",
+			comments: celplate.YAMLComments,
+			input:    "cmd: a | b\n  # ${{ x }}",
+			want:     "cmd: a | b\n  # ${{ x }}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := celplate.NewScanner(varsEvaluator{"x": "x", "x + '//'": "x//"}, celplate.WithComments(tt.comments))
+
+			output, err := sut.Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+// TestScanner_Transform_LongWhitespaceLine verifies that the whitespace
+// preceding comments is not scanned again for every character of a line.
+func TestScanner_Transform_LongWhitespaceLine(t *testing.T) {
+	spaces := strings.Repeat(" ", 1<<18)
+
+	for comments, want := range map[*celplate.Comments]string{
+		&celplate.NoComments:      spaces + "x" + spaces + "# x",
+		&celplate.DefaultComments: spaces + "x" + spaces + "# x",
+		&celplate.YAMLComments:    spaces + "x" + spaces + "# ${{ x }}",
+	} {
+		sut := celplate.NewScanner(varsEvaluator{"x": "x"}, celplate.WithComments(*comments))
+
+		output, err := sut.Transform([]byte(spaces + "${{ x }}" + spaces + "# ${{ x }}"))
+
+		require.NoError(t, err)
+		assert.True(t, want == string(output))
+	}
+}
+
+func TestScanner_Transform_UnclosedBlockComment(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"x": "x"}, celplate.WithComments(celplate.SQLComments))
+
+	_, err := sut.Transform([]byte("SELECT ${{ x }}\n/* ${{ x }}"))
+
+	assert.EqualError(t, err, `line 2, column 1: unclosed block comment, expected "*/"`)
+}
+
+func TestScanner_Transform_InvalidComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments celplate.Comments
+		want     string
+	}{
+		{
+			name:     "empty line comment prefix",
+			comments: celplate.Comments{Line: []string{""}},
+			want:     "line comment prefixes must not be empty nor contain line breaks",
+		},
+		{
+			name:     "empty block comment delimiter",
+			comments: celplate.Comments{Block: []celplate.BlockComment{{Open: "/*"}}},
+			want:     "block comment delimiters must not be empty nor contain line breaks",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := celplate.NewScanner(varsEvaluator{}, celplate.WithComments(tt.comments))
+
+			output, err := sut.Transform([]byte("a"))
+
+			assert.EqualError(t, err, tt.want)
+			assert.Nil(t, output)
+		})
+	}
+}
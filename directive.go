@@ -0,0 +1,493 @@
+package celplate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+// directive is a block directive, like "if" or "end", nested inside an
+// expression block instead of an expression.
+type directive struct {
+	keyword  string
+	argument string
+
+	// offset is the byte offset of the argument within the expression.
+	offset int
+}
+
+const (
+	keywordIf      = "if"
+	keywordElseIf  = "else if"
+	keywordElse    = "else"
+	keywordFor     = "for"
+	keywordEnd     = "end"
+	keywordInclude = "include"
+	keywordSet     = "set"
+)
+
+// identifierPattern matches valid names of loop and set variables.
+var identifierPattern = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+
+// parseDirective returns the directive in the given expression, if any.
+// Keywords taking an argument must be followed by a whitespace.
+func parseDirective(expression string) (directive, bool) {
+	trimmed := strings.TrimSpace(expression)
+	leading := len(expression) - len(strings.TrimLeftFunc(expression, unicode.IsSpace))
+
+	for _, keyword := range []string{keywordElse, keywordEnd} {
+		if trimmed == keyword {
+			return directive{keyword: keyword}, true
+		}
+	}
+
+	for _, keyword := range []string{keywordElseIf, keywordIf, keywordFor, keywordInclude, keywordSet} {
+		if argument, ok := cutKeyword(trimmed, keyword); ok {
+			offset := leading + len(trimmed) - len(argument)
+			return directive{keyword: keyword, argument: argument, offset: offset}, true
+		}
+	}
+
+	return directive{}, false
+}
+
+// cutKeyword returns the argument following the keyword, which may be empty.
+func cutKeyword(expression, keyword string) (string, bool) {
+	// Multi-word keywords may be separated by any whitespace.
+	rest := expression
+
+	for _, word := range strings.Fields(keyword) {
+		after, ok := strings.CutPrefix(rest, word)
+		if !ok || (after != "" && !unicode.IsSpace([]rune(after)[0])) {
+			return "", false
+		}
+		rest = strings.TrimLeftFunc(after, unicode.IsSpace)
+	}
+
+	return rest, true
+}
+
+// parseForArgument parses the argument of a "for" directive, which is either
+// "item in items" or "key, value in items", starting at the given location.
+func parseForArgument(argument string, start source.Location) (*ForNode, error) {
+	variables, rest, ok := strings.Cut(argument, " in ")
+	collection := strings.TrimSpace(rest)
+
+	if !ok || collection == "" {
+		return nil, errors.New(`invalid "for" directive, expected "for item in items" or "for key, value in items"`)
+	}
+
+	names := strings.Split(variables, ",")
+	if len(names) > 2 {
+		return nil, fmt.Errorf(`invalid "for" directive, expected at most two loop variables, got %d`, len(names))
+	}
+
+	for ix, name := range names {
+		names[ix] = strings.TrimSpace(name)
+
+		if !identifierPattern.MatchString(names[ix]) {
+			return nil, fmt.Errorf(`invalid "for" directive, %q is not a valid variable name`, names[ix])
+		}
+	}
+
+	node := &ForNode{
+		Value:           names[len(names)-1],
+		Collection:      collection,
+		CollectionStart: advancedBy(start, argument[:len(argument)-len(strings.TrimLeftFunc(rest, unicode.IsSpace))]),
+	}
+	if len(names) == 2 {
+		node.Key = names[0]
+
+		if node.Key == node.Value {
+			return nil, fmt.Errorf(`invalid "for" directive, variable %q is declared twice`, node.Key)
+		}
+	}
+
+	return node, nil
+}
+
+// parseSetArgument parses the argument of a "set" directive, which is
+// "name = value", starting at the given location.
+func parseSetArgument(argument string, start source.Location) (*SetNode, error) {
+	name, rest, ok := strings.Cut(argument, "=")
+	value := strings.TrimSpace(rest)
+
+	// An equality operator is not an assignment.
+	if !ok || value == "" || strings.HasPrefix(rest, "=") {
+		return nil, errors.New(`invalid "set" directive, expected "set name = value"`)
+	}
+
+	name = strings.TrimSpace(name)
+	if !identifierPattern.MatchString(name) {
+		return nil, fmt.Errorf(`invalid "set" directive, %q is not a valid variable name`, name)
+	}
+
+	return &SetNode{
+		Name:       name,
+		Value:      value,
+		ValueStart: advancedBy(start, argument[:len(argument)-len(strings.TrimLeftFunc(rest, unicode.IsSpace))]),
+	}, nil
+}
+
+// scope keeps track of the variables of a block, so that set directives can
+// be checked before the template is executed.
+type scope struct {
+	// defined holds the variables defined in the block, by set directives or
+	// by the loop itself.
+	defined map[string]bool
+
+	// used holds the variables referred to in the block, including its nested
+	// blocks, while they were not defined.
+	used map[string]bool
+}
+
+func newScope(defined ...string) *scope {
+	s := &scope{defined: map[string]bool{}, used: map[string]bool{}}
+	for _, name := range defined {
+		s.defined[name] = true
+	}
+
+	return s
+}
+
+// openBlock is a block directive waiting for its end.
+type openBlock struct {
+	keyword string
+	node    Node
+	nodes   *[]Node
+	tag     *ExpressionNode
+	scope   *scope
+
+	inElse bool
+
+	// invalid is set for blocks whose directive could not be parsed. They
+	// are dropped once closed.
+	invalid bool
+}
+
+// blockBuilder nests nodes inside of block directives, passing top-level
+// nodes to emit as soon as they are complete.
+type blockBuilder struct {
+	emit  func(Node) error
+	errs  *source.Errors
+	stack []*openBlock
+	root  *scope
+
+	// include returns the node of the file included by the tag, if any.
+	include func(tag *ExpressionNode, name string) (Node, error)
+}
+
+func newBlockBuilder(errs *source.Errors, emit func(Node) error) *blockBuilder {
+	return &blockBuilder{emit: emit, errs: errs, root: newScope()}
+}
+
+// push handles the next node of the template.
+func (b *blockBuilder) push(node Node) error {
+	tag, ok := node.(*ExpressionNode)
+	if !ok {
+		return b.add(node)
+	}
+
+	directive, ok := parseDirective(tag.Expression)
+	if !ok {
+		b.use(tag.Expression)
+		return b.add(node)
+	}
+
+	switch directive.keyword {
+	case keywordIf:
+		b.openIf(tag, directive)
+	case keywordElseIf, keywordElse:
+		b.addBranch(tag, directive)
+	case keywordFor:
+		b.openFor(tag, directive)
+	case keywordEnd:
+		return b.closeBlock(tag)
+	case keywordInclude:
+		return b.includeFile(tag, directive)
+	case keywordSet:
+		return b.set(tag, directive)
+	}
+
+	return nil
+}
+
+// finish reports blocks which were never closed.
+func (b *blockBuilder) finish() {
+	for _, block := range b.stack {
+		b.errs.Push(tagError(block.tag, fmt.Sprintf("unclosed %s block, expected an end directive", block.keyword)))
+	}
+
+	b.stack = nil
+}
+
+func (b *blockBuilder) add(node Node) error {
+	if len(b.stack) == 0 {
+		return b.emit(node)
+	}
+
+	nodes := b.stack[len(b.stack)-1].nodes
+	*nodes = appendNode(*nodes, node)
+
+	return nil
+}
+
+// scope returns the scope of the innermost open block.
+func (b *blockBuilder) scope() *scope {
+	if len(b.stack) == 0 {
+		return b.root
+	}
+
+	return b.stack[len(b.stack)-1].scope
+}
+
+// defined returns whether the variable is visible in the innermost open block.
+func (b *blockBuilder) defined(name string) bool {
+	if b.root.defined[name] {
+		return true
+	}
+
+	for _, block := range b.stack {
+		if block.scope.defined[name] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// use records the variables the expression refers to which are not defined
+// yet.
+func (b *blockBuilder) use(expression string) {
+	for _, name := range rootIdentifiers(expression) {
+		if !b.defined(name) {
+			b.scope().used[name] = true
+		}
+	}
+}
+
+// leaveScope passes the variables used in the innermost open block to the
+// enclosing one, so that they cannot be defined there afterwards.
+func (b *blockBuilder) leaveScope() {
+	used := b.scope().used
+
+	parent := b.root
+	if len(b.stack) > 1 {
+		parent = b.stack[len(b.stack)-2].scope
+	}
+
+	for name := range used {
+		if !parent.defined[name] {
+			parent.used[name] = true
+		}
+	}
+}
+
+func (b *blockBuilder) openIf(tag *ExpressionNode, directive directive) {
+	// The block is still opened without a condition, so that its end
+	// directive is matched.
+	missing := b.missingCondition(tag, directive)
+
+	b.use(directive.argument)
+
+	branch := newIfBranch(tag, directive)
+	node := &IfNode{Branches: []*IfBranch{branch}, Start: tag.Start}
+
+	b.stack = append(b.stack, &openBlock{
+		keyword: keywordIf,
+		node:    node,
+		nodes:   &branch.Nodes,
+		tag:     tag,
+		scope:   newScope(),
+		invalid: missing,
+	})
+}
+
+// missingCondition reports a conditional directive without a condition, and
+// returns whether it's missing.
+func (b *blockBuilder) missingCondition(tag *ExpressionNode, directive directive) bool {
+	if directive.argument != "" || directive.keyword == keywordElse {
+		return false
+	}
+
+	b.errs.Push(tagError(tag, fmt.Sprintf("missing condition in %q directive", directive.keyword)))
+	return true
+}
+
+func (b *blockBuilder) addBranch(tag *ExpressionNode, directive directive) {
+	var block *openBlock
+	if len(b.stack) > 0 {
+		block = b.stack[len(b.stack)-1]
+	}
+
+	if block == nil || block.keyword != keywordIf {
+		b.errs.Push(tagError(tag, fmt.Sprintf("unexpected %q directive outside of an if block", directive.keyword)))
+		return
+	}
+
+	if block.inElse {
+		b.errs.Push(tagError(tag, fmt.Sprintf("unexpected %q directive after an else directive", directive.keyword)))
+		return
+	}
+
+	node := block.node.(*IfNode)
+
+	// Every branch has its own scope, and its condition is evaluated in the
+	// enclosing one.
+	b.leaveScope()
+	b.stack = b.stack[:len(b.stack)-1]
+	b.use(directive.argument)
+	b.stack = append(b.stack, block)
+	block.scope = newScope()
+
+	if directive.keyword == keywordElse {
+		block.inElse = true
+		node.Else = []Node{}
+		block.nodes = &node.Else
+		return
+	}
+
+	// The branch is still added without a condition, so that its nodes are
+	// not attached to the previous one.
+	if b.missingCondition(tag, directive) {
+		block.invalid = true
+	}
+
+	branch := newIfBranch(tag, directive)
+	node.Branches = append(node.Branches, branch)
+	block.nodes = &branch.Nodes
+}
+
+func (b *blockBuilder) openFor(tag *ExpressionNode, directive directive) {
+	node, err := parseForArgument(directive.argument, argumentStart(tag, directive))
+	if err != nil {
+		b.errs.Push(tagError(tag, err.Error()))
+
+		// The block is still opened, so that its end directive is matched.
+		node = &ForNode{}
+	}
+
+	b.use(node.Collection)
+
+	node.Start = tag.Start
+	b.stack = append(b.stack, &openBlock{
+		keyword: keywordFor,
+		node:    node,
+		nodes:   &node.Nodes,
+		tag:     tag,
+		scope:   newScope(node.Key, node.Value),
+		invalid: err != nil,
+	})
+}
+
+func (b *blockBuilder) closeBlock(tag *ExpressionNode) error {
+	if len(b.stack) == 0 {
+		b.errs.Push(tagError(tag, "unexpected end directive without an open block"))
+		return nil
+	}
+
+	b.leaveScope()
+
+	block := b.stack[len(b.stack)-1]
+	b.stack = b.stack[:len(b.stack)-1]
+
+	if block.invalid {
+		return nil
+	}
+
+	switch node := block.node.(type) {
+	case *IfNode:
+		node.End = tag.End
+	case *ForNode:
+		node.End = tag.End
+	}
+
+	return b.add(block.node)
+}
+
+func (b *blockBuilder) includeFile(tag *ExpressionNode, directive directive) error {
+	name, err := strconv.Unquote(directive.argument)
+	if err != nil {
+		b.errs.Push(tagError(tag, `invalid "include" directive, expected a quoted file name`))
+		return nil
+	}
+
+	node, err := b.include(tag, name)
+	if err != nil || node == nil {
+		return err
+	}
+
+	return b.add(node)
+}
+
+// set defines the variable of a set directive in the innermost open block.
+func (b *blockBuilder) set(tag *ExpressionNode, directive directive) error {
+	node, err := parseSetArgument(directive.argument, argumentStart(tag, directive))
+	if err != nil {
+		b.errs.Push(tagError(tag, err.Error()))
+		return nil
+	}
+
+	b.use(node.Value)
+
+	switch scope := b.scope(); {
+	case b.defined(node.Name):
+		b.errs.Push(tagError(tag, fmt.Sprintf("variable %q is already defined", node.Name)))
+		return nil
+	case scope.used[node.Name]:
+		b.errs.Push(tagError(tag, fmt.Sprintf("variable %q is used before its definition", node.Name)))
+		return nil
+	default:
+		scope.defined[node.Name] = true
+	}
+
+	node.Start, node.End = tag.Start, tag.End
+	return b.add(node)
+}
+
+// newIfBranch returns a branch with the condition of the given directive.
+func newIfBranch(tag *ExpressionNode, directive directive) *IfBranch {
+	return &IfBranch{
+		Condition:      directive.argument,
+		Start:          tag.Start,
+		End:            tag.End,
+		ConditionStart: argumentStart(tag, directive),
+	}
+}
+
+// argumentStart returns the location of the first character of the argument
+// of the directive in the tag.
+func argumentStart(tag *ExpressionNode, directive directive) source.Location {
+	return advancedBy(tag.ExpressionStart, tag.Expression[:directive.offset])
+}
+
+// tagError returns an error reported for the whole tag.
+func tagError(tag *ExpressionNode, message string) *source.Error {
+	return &source.Error{
+		Location: tag.Start,
+		Range:    source.Range{Start: tag.Start, End: tag.End},
+		Message:  message,
+	}
+}
+
+// appendNode adds the node to the list, merging adjacent text nodes.
+func appendNode(nodes []Node, node Node) []Node {
+	if text, ok := node.(*TextNode); ok && len(nodes) > 0 {
+		if last, ok := nodes[len(nodes)-1].(*TextNode); ok {
+			if last.Source != "" || text.Source != "" {
+				last.Source = last.source() + text.source()
+			}
+
+			last.Text += text.Text
+			last.End = text.End
+			return nodes
+		}
+	}
+
+	return append(nodes, node)
+}
@@ -0,0 +1,652 @@
+package celplate_test
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestParse_IfBlock(t *testing.T) {
+	template, err := celplate.Parse([]byte("${{ if a }}A${{ else if b }}B${{ else }}C${{ end }}!"))
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Node{
+		&celplate.IfNode{
+			Branches: []*celplate.IfBranch{
+				{
+					Condition: "a",
+					Nodes: []celplate.Node{&celplate.TextNode{
+						Text:  "A",
+						Start: source.Location{Index: 11, Line: 1, Column: 12, Offset: 11, UTF16Column: 12},
+						End:   source.Location{Index: 12, Line: 1, Column: 13, Offset: 12, UTF16Column: 13},
+					}},
+					Start:          source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+					End:            source.Location{Index: 11, Line: 1, Column: 12, Offset: 11, UTF16Column: 12},
+					ConditionStart: source.Location{Index: 7, Line: 1, Column: 8, Offset: 7, UTF16Column: 8},
+				},
+				{
+					Condition: "b",
+					Nodes: []celplate.Node{&celplate.TextNode{
+						Text:  "B",
+						Start: source.Location{Index: 28, Line: 1, Column: 29, Offset: 28, UTF16Column: 29},
+						End:   source.Location{Index: 29, Line: 1, Column: 30, Offset: 29, UTF16Column: 30},
+					}},
+					Start:          source.Location{Index: 12, Line: 1, Column: 13, Offset: 12, UTF16Column: 13},
+					End:            source.Location{Index: 28, Line: 1, Column: 29, Offset: 28, UTF16Column: 29},
+					ConditionStart: source.Location{Index: 24, Line: 1, Column: 25, Offset: 24, UTF16Column: 25},
+				},
+			},
+			Else: []celplate.Node{&celplate.TextNode{
+				Text:  "C",
+				Start: source.Location{Index: 40, Line: 1, Column: 41, Offset: 40, UTF16Column: 41},
+				End:   source.Location{Index: 41, Line: 1, Column: 42, Offset: 41, UTF16Column: 42},
+			}},
+			Start: source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+			End:   source.Location{Index: 51, Line: 1, Column: 52, Offset: 51, UTF16Column: 52},
+		},
+		&celplate.TextNode{
+			Text:  "!",
+			Start: source.Location{Index: 51, Line: 1, Column: 52, Offset: 51, UTF16Column: 52},
+			End:   source.Location{Index: 52, Line: 1, Column: 53, Offset: 52, UTF16Column: 53},
+		},
+	}, template.Nodes())
+}
+
+func TestParse_MismatchedBlocks(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "unclosed if block",
+			input: "a\n  ${{ if a }}\nb",
+			want:  "line 2, column 3 to line 2, column 14: unclosed if block, expected an end directive",
+		},
+		{
+			name:  "unclosed nested if block",
+			input: "${{ if a }}${{ if b }}${{ end }}",
+			want:  "line 1, column 1 to line 1, column 12: unclosed if block, expected an end directive",
+		},
+		{
+			name:  "end without a block",
+			input: "a ${{ end }}",
+			want:  "line 1, column 3 to line 1, column 13: unexpected end directive without an open block",
+		},
+		{
+			name:  "else without a block",
+			input: "a ${{ else }}",
+			want:  `line 1, column 3 to line 1, column 14: unexpected "else" directive outside of an if block`,
+		},
+		{
+			name:  "else if without a block",
+			input: "a ${{ else if b }}",
+			want:  `line 1, column 3 to line 1, column 19: unexpected "else if" directive outside of an if block`,
+		},
+		{
+			name:  "else if after else",
+			input: "${{ if a }}${{ else }}${{ else if b }}${{ end }}",
+			want:  `line 1, column 23 to line 1, column 39: unexpected "else if" directive after an else directive`,
+		},
+		{
+			name:  "double else",
+			input: "${{ if a }}${{ else }}${{ else }}${{ end }}",
+			want:  `line 1, column 23 to line 1, column 34: unexpected "else" directive after an else directive`,
+		},
+		{
+			name:  "if without a condition",
+			input: "${{ if }}${{ end }}",
+			want:  `line 1, column 1 to line 1, column 10: missing condition in "if" directive`,
+		},
+		{
+			name:  "else if without a condition",
+			input: "${{ if a }}${{ else if }}${{ end }}${{ end }}",
+			want:  `line 1, column 12 to line 1, column 26: missing condition in "else if" directive; line 1, column 36 to line 1, column 46: unexpected end directive without an open block`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template, err := celplate.Parse([]byte(tt.input))
+
+			assert.EqualError(t, err, tt.want)
+			assert.Nil(t, template)
+		})
+	}
+}
+
+func TestScanner_Transform_IfBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b any
+		want string
+	}{
+		{name: "if branch", a: true, b: true, want: "<A x>"},
+		{name: "else if branch", a: false, b: true, want: "<B>"},
+		{name: "else branch", a: false, b: false, want: "<C>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := new(mockEvaluator)
+			ev.On("EvaluateValue", "a").Return(tt.a, nil)
+			ev.On("EvaluateValue", "b").Return(tt.b, nil)
+			ev.On("Evaluate", " x ").Return("x", nil)
+			sut := celplate.NewScanner(ev)
+
+			output, err := sut.Transform([]byte("<${{ if a }}A ${{ x }}${{ else if b }}B${{ else }}C${{ end }}>"))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestScanner_Transform_NestedIfBlocks(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("EvaluateValue", "a").Return(true, nil)
+	ev.On("EvaluateValue", "b").Return(false, nil)
+	sut := celplate.NewScanner(ev)
+
+	output, err := sut.Transform([]byte("${{ if a }}A${{ if b }}B${{ else }}C${{ end }}${{ end }}${{ if b }}D${{ end }}"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "AC", string(output))
+}
+
+func TestScanner_Transform_IfBlockConditionErrors(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("EvaluateValue", "a").Return("yes", nil)
+	ev.On("EvaluateValue", "b").Return(nil, errors.New("error"))
+	sut := celplate.NewScanner(ev)
+
+	output, err := sut.Transform([]byte("${{ if a }}A${{ end }}\n${{ if b }}B${{ end }}"))
+
+	assert.EqualError(t, err, "line 1, column 8 to line 1, column 9: condition must evaluate to a bool, got string; line 2, column 8 to line 2, column 9: error")
+	assert.Nil(t, output)
+}
+
+func TestScanner_Transform_IfBlockUnsupportedEvaluator(t *testing.T) {
+	sut := celplate.NewScanner(stringEvaluator(func(string) (string, error) { return "", nil }))
+
+	output, err := sut.Transform([]byte("a\n${{ if a }}A${{ end }}"))
+
+	assert.EqualError(t, err, "line 2, column 1: the evaluator does not support conditions")
+	assert.Nil(t, output)
+}
+
+// varsEvaluator is an evaluator which evaluates expressions by looking up
+// variables of the same names.
+type varsEvaluator map[string]any
+
+func (v varsEvaluator) Evaluate(expression string) (string, error) {
+	value, err := v.EvaluateValue(expression)
+	return fmt.Sprint(value), err
+}
+
+func (v varsEvaluator) EvaluateValue(expression string) (any, error) {
+	value, ok := v[strings.TrimSpace(expression)]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %q", strings.TrimSpace(expression))
+	}
+	return value, nil
+}
+
+func (v varsEvaluator) Check(expression string) error {
+	_, err := v.EvaluateValue(expression)
+	return err
+}
+
+// CheckType returns the type of the value of the variable, which is dynamic
+// for variables without values.
+func (v varsEvaluator) CheckType(expression string) (celplate.ValueType, error) {
+	value, err := v.EvaluateValue(expression)
+	if err != nil {
+		return "", err
+	}
+
+	switch value.(type) {
+	case nil:
+		return celplate.DynType, nil
+	case bool:
+		return celplate.BoolType, nil
+	case []any, []string:
+		return celplate.ListType, nil
+	case map[string]any:
+		return celplate.MapType, nil
+	default:
+		return celplate.ValueType(fmt.Sprintf("%T", value)), nil
+	}
+}
+
+func (v varsEvaluator) References(expression string) ([]celplate.Reference, error) {
+	name := strings.TrimSpace(expression)
+	if name == "" {
+		return nil, errors.New("empty expression")
+	}
+
+	start := source.LocateOffset(expression, strings.Index(expression, name))
+	return []celplate.Reference{{Path: name, Location: start}}, nil
+}
+
+func (v varsEvaluator) WithVariables(vars map[string]any) (celplate.Evaluator, error) {
+	merged := maps.Clone(v)
+	maps.Copy(merged, vars)
+	return merged, nil
+}
+
+func TestParse_ForBlock(t *testing.T) {
+	template, err := celplate.Parse([]byte("${{ for k, v in items }}${{ v }}${{ end }}"))
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Node{
+		&celplate.ForNode{
+			Key:             "k",
+			Value:           "v",
+			Collection:      "items",
+			CollectionStart: source.Location{Index: 16, Line: 1, Column: 17, Offset: 16, UTF16Column: 17},
+			Nodes: []celplate.Node{&celplate.ExpressionNode{
+				Expression:      " v ",
+				Start:           source.Location{Index: 24, Line: 1, Column: 25, Offset: 24, UTF16Column: 25},
+				End:             source.Location{Index: 32, Line: 1, Column: 33, Offset: 32, UTF16Column: 33},
+				ExpressionStart: source.Location{Index: 27, Line: 1, Column: 28, Offset: 27, UTF16Column: 28},
+			}},
+			Start: source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+			End:   source.Location{Index: 42, Line: 1, Column: 43, Offset: 42, UTF16Column: 43},
+		},
+	}, template.Nodes())
+}
+
+func TestParse_InvalidForBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "missing collection",
+			input: "${{ for item }}${{ end }}",
+			want:  `line 1, column 1 to line 1, column 16: invalid "for" directive, expected "for item in items" or "for key, value in items"`,
+		},
+		{
+			name:  "missing argument",
+			input: "${{ for }}${{ end }}",
+			want:  `line 1, column 1 to line 1, column 11: invalid "for" directive, expected "for item in items" or "for key, value in items"`,
+		},
+		{
+			name:  "invalid variable name",
+			input: "${{ for a.b in items }}${{ end }}",
+			want:  `line 1, column 1 to line 1, column 24: invalid "for" directive, "a.b" is not a valid variable name`,
+		},
+		{
+			name:  "too many variables",
+			input: "${{ for a, b, c in items }}${{ end }}",
+			want:  `line 1, column 1 to line 1, column 28: invalid "for" directive, expected at most two loop variables, got 3`,
+		},
+		{
+			name:  "duplicate variables",
+			input: "${{ for a, a in items }}${{ end }}",
+			want:  `line 1, column 1 to line 1, column 25: invalid "for" directive, variable "a" is declared twice`,
+		},
+		{
+			name:  "unclosed block",
+			input: "${{ for a in items }}",
+			want:  `line 1, column 1 to line 1, column 22: unclosed for block, expected an end directive`,
+		},
+		{
+			name:  "else inside a for block",
+			input: "${{ for a in items }}${{ else }}${{ end }}",
+			want:  `line 1, column 22 to line 1, column 33: unexpected "else" directive outside of an if block`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template, err := celplate.Parse([]byte(tt.input))
+
+			assert.EqualError(t, err, tt.want)
+			assert.Nil(t, template)
+		})
+	}
+}
+
+func TestScanner_Transform_ForBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "list",
+			input: "${{ for item in list }}<${{ item }}>${{ end }}",
+			want:  "<a><b><c>",
+		},
+		{
+			name:  "list with index",
+			input: "${{ for ix, item in list }}${{ ix }}=${{ item }};${{ end }}",
+			want:  "0=a;1=b;2=c;",
+		},
+		{
+			name:  "map sorted by keys",
+			input: "${{ for key, value in map }}${{ key }}=${{ value }};${{ end }}",
+			want:  "a=1;b=2;c=3;",
+		},
+		{
+			name:  "map sorted by numeric keys",
+			input: "${{ for key in numbers }}${{ key }};${{ end }}",
+			want:  "two;ten;",
+		},
+		{
+			name:  "empty list",
+			input: "${{ for item in empty }}<${{ item }}>${{ end }}!",
+			want:  "!",
+		},
+		{
+			name:  "nested loops with outer variables",
+			input: "${{ for a in list }}${{ for b in list }}${{ if yes }}${{ a }}${{ b }} ${{ end }}${{ end }}${{ end }}",
+			want:  "aa ab ac ba bb bc ca cb cc ",
+		},
+		{
+			name:  "loop variable shadows a variable",
+			input: "${{ for yes in list }}${{ yes }}${{ end }}${{ yes }}",
+			want:  "abctrue",
+		},
+	}
+
+	sut := celplate.NewScanner(varsEvaluator{
+		"list":    []string{"a", "b", "c"},
+		"map":     map[string]int{"c": 3, "a": 1, "b": 2},
+		"numbers": map[int]string{10: "ten", 2: "two"},
+		"empty":   []any{},
+		"yes":     true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := sut.Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestScanner_Transform_ForBlockErrors(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{
+		"list":   []any{"a", "b"},
+		"map":    map[string]any{"x": "a", "y": "b"},
+		"string": "text",
+		"a":      "A",
+	})
+
+	_, err := sut.Transform([]byte(strings.Join([]string{
+		"${{ for item in string }}${{ end }}",
+		"${{ for item in missing }}${{ end }}",
+		"${{ for item in list }}${{ if item }}${{ end }}${{ end }}",
+		"${{ for key, item in map }}${{ if item == item }}${{ end }}${{ for i in list }}${{ other }}${{ end }}${{ end }}",
+	}, "\n")))
+
+	assert.EqualError(t, err, strings.Join([]string{
+		"line 1, column 17 to line 1, column 23: for loop collection must evaluate to a list or a map, got string",
+		`line 2, column 17 to line 2, column 24: unknown variable "missing"`,
+		"line 3, column 31 to line 3, column 35: for loop at index 0: condition must evaluate to a bool, got string",
+		"line 3, column 31 to line 3, column 35: for loop at index 1: condition must evaluate to a bool, got string",
+		`line 4, column 35 to line 4, column 47: for loop at key "x": unknown variable "item == item"`,
+		`line 4, column 80 to line 4, column 92: for loop at key "x": for loop at index 0: unknown variable "other"`,
+		`line 4, column 80 to line 4, column 92: for loop at key "x": for loop at index 1: unknown variable "other"`,
+		`line 4, column 35 to line 4, column 47: for loop at key "y": unknown variable "item == item"`,
+		`line 4, column 80 to line 4, column 92: for loop at key "y": for loop at index 0: unknown variable "other"`,
+		`line 4, column 80 to line 4, column 92: for loop at key "y": for loop at index 1: unknown variable "other"`,
+	}, "; "))
+}
+
+func TestScanner_Transform_ForBlockUnsupportedEvaluator(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+
+	_, err := sut.Transform([]byte("${{ for item in list }}${{ end }}"))
+
+	assert.EqualError(t, err, "line 1, column 1: the evaluator does not support loops")
+}
+
+func TestScanner_Transform_TrimMarkers(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "trim before",
+			input: "a  \n\t ${{- x }} b",
+			want:  "ax b",
+		},
+		{
+			name:  "trim after",
+			input: "a ${{ x -}} \n\n  b",
+			want:  "a xb",
+		},
+		{
+			name:  "trim both",
+			input: "a \n ${{- x -}} \n b",
+			want:  "axb",
+		},
+		{
+			name:  "trim around directives",
+			input: "list:\n${{- for item in list }}\n  - ${{ item }}\n${{- end }}\nnext: true",
+			want:  "list:\n  - a\n  - b\nnext: true",
+		},
+		{
+			name:  "trim after does not cross expressions",
+			input: "${{ x -}}${{ x }}  b",
+			want:  "xx  b",
+		},
+		{
+			name:  "trim before comment lines",
+			input: "${{ x -}}\n  # comment\n",
+			want:  "x# comment\n",
+		},
+		{
+			name:  "dashes without whitespace are not trim markers",
+			input: "a ${{-x}} ${{x-}} b",
+			want:  "a -x x- b",
+		},
+		{
+			name:  "escaped block is not trimmed",
+			input: "a $${{- x }} b",
+			want:  "a ${{- x }} b",
+		},
+	}
+
+	sut := celplate.NewScanner(varsEvaluator{
+		"x":    "x",
+		"-x":   "-x",
+		"x-":   "x-",
+		"list": []string{"a", "b"},
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := sut.Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestParse_TrimMarkersLocations(t *testing.T) {
+	template, err := celplate.Parse([]byte("a \n${{- x -}}\n b"))
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Node{
+		&celplate.TextNode{
+			Text:  "a",
+			Start: source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+			End:   source.Location{Index: 1, Line: 1, Column: 2, Offset: 1, UTF16Column: 2},
+		},
+		&celplate.ExpressionNode{
+			Expression:      " x ",
+			Start:           source.Location{Index: 3, Line: 2, Column: 1, Offset: 3, UTF16Column: 1},
+			End:             source.Location{Index: 13, Line: 2, Column: 11, Offset: 13, UTF16Column: 11},
+			ExpressionStart: source.Location{Index: 7, Line: 2, Column: 5, Offset: 7, UTF16Column: 5},
+		},
+		&celplate.TextNode{
+			Text:  "b",
+			Start: source.Location{Index: 15, Line: 3, Column: 2, Offset: 15, UTF16Column: 2},
+			End:   source.Location{Index: 16, Line: 3, Column: 3, Offset: 16, UTF16Column: 3},
+		},
+	}, template.Nodes())
+}
+
+func TestParse_SetDirective(t *testing.T) {
+	template, err := celplate.Parse([]byte("${{ set name = a + b }}"))
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Node{
+		&celplate.SetNode{
+			Name:       "name",
+			Value:      "a + b",
+			ValueStart: source.Location{Index: 15, Line: 1, Column: 16, Offset: 15, UTF16Column: 16},
+			Start:      source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+			End:        source.Location{Index: 23, Line: 1, Column: 24, Offset: 23, UTF16Column: 24},
+		},
+	}, template.Nodes())
+}
+
+func TestParse_InvalidSetDirective(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "missing value",
+			input: "${{ set name = }}",
+			want:  `line 1, column 1 to line 1, column 18: invalid "set" directive, expected "set name = value"`,
+		},
+		{
+			name:  "comparison",
+			input: "${{ set name == value }}",
+			want:  `line 1, column 1 to line 1, column 25: invalid "set" directive, expected "set name = value"`,
+		},
+		{
+			name:  "invalid name",
+			input: "${{ set a.b = value }}",
+			want:  `line 1, column 1 to line 1, column 23: invalid "set" directive, "a.b" is not a valid variable name`,
+		},
+		{
+			name:  "redefinition",
+			input: "${{ set a = 1 }}\n${{ set a = 2 }}",
+			want:  `line 2, column 1 to line 2, column 17: variable "a" is already defined`,
+		},
+		{
+			name:  "redefinition in a nested block",
+			input: "${{ set a = 1 }}${{ if true }}${{ set a = 2 }}${{ end }}",
+			want:  `line 1, column 31 to line 1, column 47: variable "a" is already defined`,
+		},
+		{
+			name:  "loop variable",
+			input: "${{ for item in list }}${{ set item = 1 }}${{ end }}",
+			want:  `line 1, column 24 to line 1, column 43: variable "item" is already defined`,
+		},
+		{
+			name:  "use before definition",
+			input: "${{ a.b + size(a) }}\n${{ set a = 1 }}",
+			want:  `line 2, column 1 to line 2, column 17: variable "a" is used before its definition`,
+		},
+		{
+			name:  "use in a nested block before definition",
+			input: "${{ for item in list }}${{ item + a }}${{ end }}${{ set a = 1 }}",
+			want:  `line 1, column 49 to line 1, column 65: variable "a" is used before its definition`,
+		},
+		{
+			name:  "self reference",
+			input: "${{ set a = a + 1 }}",
+			want:  `line 1, column 1 to line 1, column 21: variable "a" is used before its definition`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := celplate.Parse([]byte(tt.input))
+
+			assert.EqualError(t, err, tt.want)
+		})
+	}
+}
+
+func TestParse_SetDirectiveReferences(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "fields and functions",
+			input: "${{ x.a + a(x) + x.?a }}${{ set a = 1 }}",
+		},
+		{
+			name:  "string literals",
+			input: `${{ "a" + 'a' + r"a" + """a""" }}${{ set a = 1 }}`,
+		},
+		{
+			name:  "macro variables",
+			input: "${{ list.all(a, a > 0) }}${{ set a = 1 }}",
+		},
+		{
+			name:  "sibling blocks",
+			input: "${{ if true }}${{ set a = 1 }}${{ a }}${{ else }}${{ set a = 2 }}${{ end }}${{ set a = 3 }}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := celplate.Parse([]byte(tt.input))
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestScanner_Transform_SetDirective(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{
+		"x":    "X",
+		"yes":  true,
+		"list": []string{"a", "b"},
+	})
+
+	output, err := sut.Transform([]byte(strings.Join([]string{
+		"${{ set y = x }}${{ y }}",
+		"${{ if yes }}${{ set z = y }}${{ z }}${{ end }}",
+		"${{ for item in list }}${{ set value = item }}${{ value }}${{ end }}",
+		"${{ y }}",
+	}, "\n")))
+
+	require.NoError(t, err)
+	assert.Equal(t, "X\nX\nab\nX", string(output))
+}
+
+func TestScanner_Transform_SetDirectiveErrors(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"yes": true})
+
+	_, err := sut.Transform([]byte("${{ if yes }}${{ set z = yes }}${{ end }}\n${{ set a = missing }}${{ z }}"))
+
+	assert.EqualError(t, err, strings.Join([]string{
+		`line 2, column 13 to line 2, column 20: unknown variable "missing"`,
+		`line 2, column 23 to line 2, column 31: unknown variable "z"`,
+	}, "; "))
+}
+
+func TestScanner_Transform_SetDirectiveUnsupportedEvaluator(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+
+	_, err := sut.Transform([]byte("${{ set a = 1 }}"))
+
+	assert.EqualError(t, err, "line 1, column 1: the evaluator does not support variables")
+}
@@ -0,0 +1,227 @@
+package e2e_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func TestIfBlocks(t *testing.T) {
+	input := `stack:
+  name: ${{ inputs.name }}
+${{ if inputs.environment == "production" }}
+  protected: true
+  labels:
+    - prod
+${{ else if inputs.environment == "staging" }}
+  labels:
+    - staging
+${{ else }}
+  labels: []
+${{ end }}
+`
+
+	tests := []struct {
+		environment string
+		want        string
+	}{
+		{
+			environment: "production",
+			want:        "stack:\n  name: app\n\n  protected: true\n  labels:\n    - prod\n\n",
+		},
+		{
+			environment: "staging",
+			want:        "stack:\n  name: app\n\n  labels:\n    - staging\n\n",
+		},
+		{
+			environment: "development",
+			want:        "stack:\n  name: app\n\n  labels: []\n\n",
+		},
+	}
+
+	template, err := celplate.Parse([]byte(input))
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.environment, func(t *testing.T) {
+			cel, err := evaluator.NewCEL(map[string]map[string]any{
+				"inputs": {
+					"name":        "app",
+					"environment": tt.environment,
+				},
+			})
+			require.NoError(t, err)
+
+			output, err := template.Execute(cel)
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestIfBlocks_NonBoolCondition(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {"name": "app"},
+	})
+	require.NoError(t, err)
+
+	_, err = celplate.NewScanner(cel).Transform([]byte("a\n${{ if inputs.name }}\nb\n${{ end }}"))
+
+	assert.EqualError(t, err, "line 2, column 8 to line 2, column 19: condition must evaluate to a bool, got string")
+}
+
+func TestBlocks_CompileErrorLocations(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {"enabled": true},
+	})
+	require.NoError(t, err)
+
+	input := `${{ if !inputs.enabled }}
+a
+${{ else if  inputs.enabled && other }}
+b
+${{ end }}
+${{ for item in  missing }}
+${{ end }}`
+
+	_, err = celplate.NewScanner(cel).Transform([]byte(input))
+
+	assert.EqualError(t, err, "line 3, column 32 (within line 3, column 14 to line 3, column 37): undeclared reference to 'other' (in container ''); "+
+		"line 6, column 18 to line 6, column 25: undeclared reference to 'missing' (in container '')")
+}
+
+func TestForBlocks(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {
+			"name":    "app",
+			"regions": []string{"us-east-1", "eu-west-1"},
+			"tags":    map[string]any{"team": "platform", "cost-center": 42},
+		},
+	})
+	require.NoError(t, err)
+
+	input := `stacks:
+${{ for ix, region in inputs.regions }}
+  - name: ${{ inputs.name }}-${{ region }}
+    primary: ${{ ix == 0 }}
+    labels:
+${{ for key, value in inputs.tags }}
+      - ${{ key }}:${{ value }}
+${{ end }}
+${{ end }}
+`
+
+	output, err := celplate.NewScanner(cel).Transform([]byte(input))
+
+	require.NoError(t, err)
+	assert.Equal(t, `stacks:
+
+  - name: app-us-east-1
+    primary: true
+    labels:
+
+      - cost-center:42
+
+      - team:platform
+
+
+  - name: app-eu-west-1
+    primary: false
+    labels:
+
+      - cost-center:42
+
+      - team:platform
+
+
+`, string(output))
+}
+
+func TestForBlocks_IterationErrors(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {
+			"regions": []any{
+				map[string]any{"name": "us-east-1", "zone": "a"},
+				map[string]any{"name": "eu-west-1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	input := `${{ for region in inputs.regions }}
+- ${{ region.name }}${{ region.zone }}
+${{ end }}`
+
+	_, err = celplate.NewScanner(cel).Transform([]byte(input))
+
+	assert.EqualError(t, err, "line 2, column 21 to line 2, column 39: for loop at index 1: failed to evaluate expression: no such key: zone")
+}
+
+func TestBlocksWithTrimMarkers(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {
+			"environment": "production",
+			"regions":     []string{"us-east-1", "eu-west-1"},
+			"labels":      map[string]any{"tier": 1, "owner": "platform"},
+		},
+	})
+	require.NoError(t, err)
+
+	input, err := os.ReadFile("fixtures/blocks_input.yaml")
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile("fixtures/blocks_output.yaml")
+	require.NoError(t, err)
+
+	out, err := celplate.NewScanner(cel).Transform(input)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(out))
+}
+
+func TestSetDirective(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {
+			"environment": "production",
+			"regions":     []string{"us-east-1", "eu-west-1"},
+		},
+	})
+	require.NoError(t, err)
+
+	input := `${{- set prefix = "app-" + inputs.environment -}}
+${{ for region in inputs.regions }}
+${{- set name = prefix + "-" + region }}
+- name: ${{ name }}
+  primary: ${{ name == prefix + "-" + inputs.regions[0] }}
+${{- end }}
+default: ${{ prefix }}
+`
+
+	output, err := celplate.NewScanner(cel).Transform([]byte(input))
+
+	require.NoError(t, err)
+	assert.Equal(t, `
+- name: app-production-us-east-1
+  primary: true
+- name: app-production-eu-west-1
+  primary: false
+default: app-production
+`, string(output))
+}
+
+func TestSetDirective_Errors(t *testing.T) {
+	input := `${{ inputs.region.upperAscii() }}
+${{ set inputs = {"region": "eu"} }}
+${{ set region = inputs.region }}
+${{ set region = "us" }}`
+
+	_, err := celplate.Parse([]byte(input))
+
+	assert.EqualError(t, err, `line 2, column 1 to line 2, column 37: variable "inputs" is used before its definition; `+
+		`line 4, column 1 to line 4, column 25: variable "region" is already defined`)
+}
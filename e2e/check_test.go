@@ -0,0 +1,67 @@
+package e2e_test
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func TestCheck(t *testing.T) {
+	eval, err := evaluator.NewCEL(nil, evaluator.WithTypes(map[string]*cel.Type{
+		"inputs": cel.MapType(cel.StringType, cel.DynType),
+		"count":  cel.IntType,
+	}))
+	require.NoError(t, err)
+
+	input := `name: ${{ inputs.name }}
+${{ if count > 1 }}
+replicas: ${{ count + "1" }}
+${{ end }}
+${{ set prefix = inputs.name + "-" }}
+regions:
+${{ for region in inputs.regions }}
+  - ${{ prefix + region }}
+  - ${{ prefix + }}
+${{ end }}
+${{ missing }}`
+
+	err = celplate.NewScanner(eval, celplate.WithFileName("stack.yaml")).Check([]byte(input))
+
+	assert.EqualError(t, err, "stack.yaml: line 3, column 21 (within stack.yaml: line 3, column 11 to line 3, column 29): found no matching overload for '_+_' applied to '(int, string)'; "+
+		"stack.yaml: line 9, column 18 (within stack.yaml: line 9, column 5 to line 9, column 20): Syntax error: mismatched input '<EOF>' expecting "+
+		"{'[', '{', '(', '.', '-', '!', 'true', 'false', 'null', NUM_FLOAT, NUM_INT, NUM_UINT, STRING, BYTES, IDENTIFIER}; "+
+		"stack.yaml: line 11, column 5 (within stack.yaml: line 11, column 1 to line 11, column 15): undeclared reference to 'missing' (in container '')")
+}
+
+func TestCheck_Valid(t *testing.T) {
+	eval, err := evaluator.NewCEL(map[string]map[string]any{"inputs": nil})
+	require.NoError(t, err)
+
+	template, err := celplate.Parse([]byte("${{ for item in inputs.items }}${{ set name = item.name }}${{ name }}${{ end }}"))
+	require.NoError(t, err)
+
+	assert.NoError(t, template.Check(eval))
+}
+
+func TestCheck_Types(t *testing.T) {
+	eval, err := evaluator.NewCEL(nil, evaluator.WithTypes(map[string]*cel.Type{
+		"inputs": cel.MapType(cel.StringType, cel.DynType),
+		"count":  cel.IntType,
+	}))
+	require.NoError(t, err)
+
+	input := `${{ if count }}${{ end }}
+${{ if inputs.enabled }}${{ end }}
+${{ for region in inputs.name.split(",") }}${{ end }}
+${{ for region in inputs.name + "" }}${{ end }}`
+
+	err = celplate.NewScanner(eval).Check([]byte(input))
+
+	assert.EqualError(t, err, "line 1, column 8 to line 1, column 13: condition must evaluate to a bool, got int; "+
+		"line 4, column 19 to line 4, column 35: for loop collection must evaluate to a list or a map, got string")
+}
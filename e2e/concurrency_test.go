@@ -0,0 +1,44 @@
+package e2e_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+// TestConcurrentTransform verifies that a single scanner can be shared by
+// multiple goroutines. Run it with the race detector enabled.
+func TestConcurrentTransform(t *testing.T) {
+	eval, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {
+			"environment": "production",
+		},
+	})
+	require.NoError(t, err)
+
+	scanner := celplate.NewScanner(eval)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			input := fmt.Sprintf("id: ${{ string(%d) }}\nenvironment: ${{ inputs.environment }}\nmissing: ${{ inputs.missing }}", i)
+			_, err := scanner.Transform([]byte(input))
+			assert.ErrorContains(t, err, "line 3, column 10 to line 3, column 31: failed to evaluate expression: no such key: missing")
+
+			input = fmt.Sprintf("id: ${{ string(%d) }}\nenvironment: ${{ inputs.environment }}", i)
+			output, err := scanner.Transform([]byte(input))
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("id: %d\nenvironment: production", i), string(output))
+		}()
+	}
+	wg.Wait()
+}
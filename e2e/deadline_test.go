@@ -0,0 +1,37 @@
+package e2e_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+// TestTransformContext_Deadline verifies that a runaway comprehension is
+// interrupted once the deadline passes.
+func TestTransformContext_Deadline(t *testing.T) {
+	items := make([]int, 5000)
+
+	eval, err := evaluator.NewCEL(
+		map[string]map[string]any{"inputs": {"items": items}},
+		evaluator.WithTypes(map[string]*cel.Type{"inputs": cel.MapType(cel.StringType, cel.DynType)}),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	input := "count: ${{ inputs.items.map(x, inputs.items.map(y, x + y)).size() }}"
+
+	start := time.Now()
+	_, err = celplate.NewScanner(eval).TransformContext(ctx, []byte(input))
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,35 @@
+package e2e_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func TestIncludes(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {
+			"environment": "production",
+			"regions":     []string{"us-east-1", "eu-west-1"},
+			"labels":      map[string]string{"owner": "platform", "tier": "backend"},
+		},
+	})
+	require.NoError(t, err)
+
+	input, err := os.ReadFile("fixtures/include_input.yaml")
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile("fixtures/include_output.yaml")
+	require.NoError(t, err)
+
+	sut := celplate.NewScanner(cel, celplate.WithIncludes(celplate.Includes{FS: os.DirFS("fixtures"), Indent: true}))
+
+	out, err := sut.Transform(input)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(out))
+}
@@ -0,0 +1,62 @@
+package e2e_test
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestLimits(t *testing.T) {
+	eval, err := evaluator.NewCEL(
+		map[string]map[string]any{"inputs": {"name": "app", "items": []int{1, 2, 3, 4, 5}}},
+		evaluator.WithTypes(map[string]*cel.Type{"inputs": cel.MapType(cel.StringType, cel.DynType)}),
+		evaluator.WithLimits(evaluator.Limits{Cost: 100, ExpressionLength: 80, Depth: 10, OutputSize: 10}),
+	)
+	require.NoError(t, err)
+
+	input := `name: ${{ inputs.name }}
+cost: ${{ inputs.items.map(x, inputs.items.map(y, x * y)).size() }}
+length: ${{ inputs.name + inputs.name + inputs.name + inputs.name + inputs.name + inputs.name }}
+depth: ${{ ((((((((((1 + 1) + 1) + 1) + 1) + 1) + 1) + 1) + 1) + 1) + 1) }}
+size: ${{ inputs.name + inputs.name + inputs.name + inputs.name }}`
+
+	sut := celplate.NewScanner(eval, celplate.WithFileName("stack.yaml"), celplate.WithMaxOutputSize(100))
+
+	_, err = sut.Transform([]byte(input))
+
+	assert.EqualError(t, err, "stack.yaml: line 2, column 7 to line 2, column 68: expression exceeds the cost limit of 100; "+
+		"stack.yaml: line 3, column 9 to line 3, column 97: expression is 83 characters long, exceeding the limit of 80 characters; "+
+		"stack.yaml: line 4, column 8 to line 4, column 76: expression is nested 11 levels deep, exceeding the limit of 10 levels; "+
+		"stack.yaml: line 5, column 7 to line 5, column 67: result is 12 bytes long, exceeding the limit of 10 bytes")
+
+	var limits []string
+	for _, sourceErr := range source.GetErrors(err) {
+		var limitErr *evaluator.LimitError
+		require.ErrorAs(t, sourceErr, &limitErr)
+		limits = append(limits, limitErr.Limit)
+	}
+	assert.Equal(t, []string{celplate.CostLimit, celplate.ExpressionLengthLimit, celplate.DepthLimit, celplate.ResultSizeLimit}, limits)
+}
+
+func TestLimits_OutputSize(t *testing.T) {
+	eval, err := evaluator.NewCEL(map[string]map[string]any{"inputs": {"name": "app"}})
+	require.NoError(t, err)
+
+	input := "${{ for i in [1, 2, 3, 4, 5, 6, 7, 8, 9, 10] }}\n- ${{ inputs.name }}-${{ i }}\n${{ end }}"
+
+	sut := celplate.NewScanner(eval, celplate.WithFileName("stack.yaml"), celplate.WithMaxOutputSize(30))
+
+	_, err = sut.Transform([]byte(input))
+
+	assert.EqualError(t, err, "stack.yaml: line 2, column 3 to line 2, column 21: for loop at index 3: output exceeds the limit of 30 bytes")
+
+	var limitErr *celplate.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, &celplate.LimitError{Limit: celplate.OutputSizeLimit, Value: 33, Max: 30}, limitErr)
+}
@@ -0,0 +1,45 @@
+package e2e_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestLineEndings(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {
+			"environment": "production",
+			"region":      "us-east-1",
+			"regions":     []string{"us-east-1", "eu-west-1"},
+		},
+	})
+	require.NoError(t, err)
+
+	input, err := os.ReadFile("fixtures/crlf_input.yaml")
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile("fixtures/crlf_output.yaml")
+	require.NoError(t, err)
+
+	out, err := celplate.NewScanner(cel).Transform(input)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(out))
+}
+
+func TestLineEndings_ErrorLocation(t *testing.T) {
+	cel, err := evaluator.NewCEL(map[string]map[string]any{"inputs": {}})
+	require.NoError(t, err)
+
+	_, err = celplate.NewScanner(cel).Transform([]byte("\ufeffa: 1\r\nb: ${{\r\n  inputs +\r\n}}"))
+
+	errs := source.GetErrors(err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, source.Location{Index: 26, Line: 4, Column: 1, Offset: 29, UTF16Column: 1}, errs[0].Location)
+}
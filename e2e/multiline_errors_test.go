@@ -138,4 +138,70 @@ line three`
 		errorStr := errs[0].Error()
 		assert.True(t, strings.HasPrefix(errorStr, "line 2, column"))
 	})
+
+	// Test case 6: Expressions spanning lines which look like comments
+	t.Run("multi-line expression with comment-like lines", func(t *testing.T) {
+		input := `value: ${{ inputs.existing + """
+# not a comment
+""" }}
+# a comment ${{ inputs.missing }}`
+
+		scanner := celplate.NewScanner(eval)
+		output, err := scanner.Transform([]byte(input))
+
+		require.NoError(t, err)
+		assert.Equal(t, "value: value\n# not a comment\n\n# a comment ${{ inputs.missing }}", string(output))
+	})
+
+	// Test case 7: Syntax errors inside multi-line expressions
+	t.Run("syntax error in multi-line expression", func(t *testing.T) {
+		input := `first line
+value: ${{
+  inputs.existing +
+  # not a comment
+}}`
+
+		scanner := celplate.NewScanner(eval)
+		_, err := scanner.Transform([]byte(input))
+
+		require.Error(t, err)
+
+		errs := source.GetErrors(err)
+		require.NotEmpty(t, errs)
+
+		// The error should point at the hash inside the expression
+		assert.Equal(t, 4, errs[0].Location.Line)
+		assert.Equal(t, 3, errs[0].Location.Column)
+		assert.Equal(t, 44, errs[0].Location.Index)
+	})
+}
+
+// TestMultiFileErrorReporting verifies that errors of several templates can be
+// reported together, each with the name of its file.
+func TestMultiFileErrorReporting(t *testing.T) {
+	eval, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {"existing": "value"},
+	})
+	require.NoError(t, err)
+
+	files := []struct{ name, input string }{
+		{"stacks/a.yaml", "name: ${{ inputs.existing }}\nregion: ${{ inputs.missing }}"},
+		{"stacks/b.yaml", "name: ${{ inputs.existing }}"},
+		{"stacks/c.yaml", "name: ${{ inputs. }}"},
+	}
+
+	errs := &source.Errors{}
+	for _, file := range files {
+		_, err := celplate.NewScanner(eval, celplate.WithFileName(file.name)).Transform([]byte(file.input))
+		errs.Push(err)
+	}
+
+	result := source.GetErrors(errs.ErrorOrNil())
+	require.Len(t, result, 2)
+
+	assert.Equal(t, "stacks/a.yaml", result[0].Location.File)
+	assert.Equal(t, 2, result[0].Location.Line)
+
+	assert.Equal(t, "stacks/c.yaml", result[1].Location.File)
+	assert.True(t, strings.HasPrefix(result[1].Error(), "stacks/c.yaml: line 1, column"))
 }
@@ -0,0 +1,168 @@
+package e2e_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/cel-go/cel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func TestTransformPartial(t *testing.T) {
+	input := `# ${{ inputs.name }}
+name: ${{ context.stack + "-" + inputs.name }}
+escaped: $${{ context.stack }}
+${{ set prefix = context.stack + "-" }}
+${{- if context.protected }}
+protected: true
+${{- end }}
+${{- if inputs.environment == "production" }}
+tier: ${{ prefix }}gold
+${{- else if context.protected }}
+tier: silver
+${{- else }}
+tier: bronze
+${{- end }}
+regions:
+${{- for region in context.regions }}
+  - ${{ prefix + region + "-" + inputs.suffix }}
+${{- end }}
+zones:
+${{- for zone in inputs.zones }}
+  - ${{ prefix + zone }}
+${{- end }}
+${{ set owner = inputs.owner + "@" + context.domain -}}
+owner: ${{ owner }}
+labels: ${{ inputs.labels.map(label, label.upperAscii()) }}
+names: ${{ inputs.labels.map(label, context.stack + "-" + label) }}
+`
+
+	context := map[string]any{
+		"stack":     "app",
+		"protected": true,
+		"regions":   []string{"us", "eu"},
+		"domain":    "example.com",
+	}
+	inputs := map[string]any{
+		"name":        "web",
+		"environment": "staging",
+		"suffix":      "1",
+		"zones":       []string{"a", "b"},
+		"owner":       "ops",
+		"labels":      []string{"x"},
+	}
+
+	types := evaluator.WithTypes(map[string]*cel.Type{"inputs": cel.MapType(cel.StringType, cel.DynType)})
+
+	planned, err := evaluator.NewCEL(map[string]map[string]any{"context": context}, types)
+	require.NoError(t, err)
+
+	partial, err := celplate.NewScanner(planned).TransformPartial([]byte(input))
+	require.NoError(t, err)
+
+	assert.Equal(t, `# ${{ inputs.name }}
+name: ${{ "app-" + inputs.name }}
+escaped: $${{ context.stack }}
+
+protected: true${{ if inputs.environment == "production" }}
+tier: app-gold${{ else }}
+tier: silver${{ end }}
+regions:
+  - ${{ "app-us-" + inputs.suffix }}
+  - ${{ "app-eu-" + inputs.suffix }}
+zones:${{ for zone in inputs.zones }}
+  - ${{ "app-" + zone }}${{ end }}
+${{ set owner = inputs.owner + "@" + "example.com" }}owner: ${{ owner }}
+labels: ${{ inputs.labels.map(label, label.upperAscii()) }}
+names: ${{ inputs.labels.map(label, "app-" + label) }}
+`, string(partial))
+
+	complete, err := evaluator.NewCEL(map[string]map[string]any{"inputs": inputs}, types)
+	require.NoError(t, err)
+
+	staged, err := celplate.NewScanner(complete).Transform(partial)
+	require.NoError(t, err)
+
+	all, err := evaluator.NewCEL(map[string]map[string]any{"context": context, "inputs": inputs}, types)
+	require.NoError(t, err)
+
+	direct, err := celplate.NewScanner(all).Transform([]byte(input))
+	require.NoError(t, err)
+
+	assert.Equal(t, string(direct), string(staged))
+}
+
+func TestTransformPartial_Errors(t *testing.T) {
+	eval, err := evaluator.NewCEL(
+		map[string]map[string]any{"context": {"items": []string{"a"}}},
+		evaluator.WithTypes(map[string]*cel.Type{"inputs": cel.MapType(cel.StringType, cel.DynType)}),
+	)
+	require.NoError(t, err)
+
+	_, err = celplate.NewScanner(eval).TransformPartial([]byte("${{ context.missing }}\n${{ inputs.items.map(i, i + context.items[1]) }}"))
+
+	assert.EqualError(t, err, "line 1, column 1 to line 1, column 23: failed to evaluate expression: no such key: missing; "+
+		"line 2, column 1 to line 2, column 49: failed to partially evaluate expression, variables with values cannot be replaced in it")
+}
+
+// TestTransformPartial_ScopedSet verifies that set directives written back
+// inside of loops and branches which are rendered stay scoped to them.
+func TestTransformPartial_ScopedSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		partial string
+	}{
+		{
+			name:    "loop",
+			input:   `${{ for x in context.list }}${{ set y = x + inputs.q }}${{ y }};${{ end }}`,
+			partial: `${{ if true }}${{ set y = "a" + inputs.q }}${{ y }};${{ end }}${{ if true }}${{ set y = "b" + inputs.q }}${{ y }};${{ end }}`,
+		},
+		{
+			name:    "branch",
+			input:   `${{ if context.enabled }}${{ set y = "a" + inputs.q }}${{ y }};${{ end }}${{ set y = "b" + inputs.q }}${{ y }}`,
+			partial: `${{ if true }}${{ set y = "a" + inputs.q }}${{ y }};${{ end }}${{ set y = "b" + inputs.q }}${{ y }}`,
+		},
+		{
+			name:    "include",
+			input:   `${{ include "set.txt" }};${{ set y = "b" + inputs.q }}${{ y }}`,
+			partial: `${{ if true }}${{ set y = "a" + inputs.q }}${{ y }}${{ end }};${{ set y = "b" + inputs.q }}${{ y }}`,
+		},
+	}
+
+	context := map[string]any{"list": []string{"a", "b"}, "enabled": true}
+	inputs := map[string]any{"q": "!"}
+	types := evaluator.WithTypes(map[string]*cel.Type{"inputs": cel.MapType(cel.StringType, cel.DynType)})
+	includes := celplate.WithIncludes(celplate.Includes{FS: fstest.MapFS{
+		"set.txt": {Data: []byte(`${{ set y = "a" + inputs.q }}${{ y }}`)},
+	}})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			planned, err := evaluator.NewCEL(map[string]map[string]any{"context": context}, types)
+			require.NoError(t, err)
+
+			partial, err := celplate.NewScanner(planned, includes).TransformPartial([]byte(tt.input))
+			require.NoError(t, err)
+			assert.Equal(t, tt.partial, string(partial))
+
+			complete, err := evaluator.NewCEL(map[string]map[string]any{"inputs": inputs}, types)
+			require.NoError(t, err)
+
+			staged, err := celplate.NewScanner(complete).Transform(partial)
+			require.NoError(t, err)
+
+			all, err := evaluator.NewCEL(map[string]map[string]any{"context": context, "inputs": inputs}, types)
+			require.NoError(t, err)
+
+			direct, err := celplate.NewScanner(all, includes).Transform([]byte(tt.input))
+			require.NoError(t, err)
+
+			assert.Equal(t, string(direct), string(staged))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package e2e_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func TestReferences(t *testing.T) {
+	eval, err := evaluator.NewCEL(nil)
+	require.NoError(t, err)
+
+	input := `name: ${{ inputs.name }}-${{ context.stack.id }}
+${{ if has(inputs.protected) && inputs.protected }}
+protected: true
+${{ end }}
+${{ for region in inputs.regions }}
+  - ${{ region.name }}: ${{ inputs.zones[region.name].map(zone, zone.upperAscii()) }}
+${{ end }}`
+
+	references, err := celplate.NewScanner(eval).References([]byte(input))
+	require.NoError(t, err)
+
+	var paths, locations []string
+	for _, ref := range references {
+		paths = append(paths, ref.Path)
+		locations = append(locations, ref.Location.String())
+	}
+
+	assert.Equal(t, []string{
+		"inputs.name",
+		"context.stack.id",
+		"inputs.protected",
+		"inputs.protected",
+		"inputs.regions",
+		"inputs.zones",
+	}, paths)
+	assert.Equal(t, []string{
+		"line 1, column 11",
+		"line 1, column 30",
+		"line 2, column 12",
+		"line 2, column 33",
+		"line 5, column 19",
+		"line 6, column 29",
+	}, locations)
+}
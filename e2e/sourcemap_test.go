@@ -0,0 +1,45 @@
+package e2e_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func TestSourceMap(t *testing.T) {
+	eval, err := evaluator.NewCEL(map[string]map[string]any{
+		"inputs": {"name": "app", "description": "broken: value", "regions": []string{"eu-west-1", "us-east-1"}},
+	})
+	require.NoError(t, err)
+
+	input := `name: ${{ inputs.name }}
+regions:
+${{- for region in inputs.regions }}
+  - ${{ region }}
+${{- end }}
+description: ${{ inputs.description }}
+`
+
+	output, sourceMap, err := celplate.NewScanner(eval, celplate.WithFileName("stack.yaml")).TransformWithSourceMap([]byte(input))
+	require.NoError(t, err)
+	assert.Equal(t, "name: app\nregions:\n  - eu-west-1\n  - us-east-1\ndescription: broken: value\n", string(output))
+
+	// A YAML parser would complain about the second colon on the last line.
+	offset := strings.LastIndex(string(output), ": ")
+
+	location := sourceMap.Lookup(offset)
+	assert.Equal(t, "stack.yaml: line 6, column 14", location.String())
+
+	segment, ok := sourceMap.SegmentAt(offset)
+	require.True(t, ok)
+	assert.Equal(t, "inputs.description", segment.Expression)
+
+	// Text repeated by loops maps to the body of the loop.
+	location = sourceMap.Lookup(strings.Index(string(output), "us-east-1") - 2)
+	assert.Equal(t, "stack.yaml: line 4, column 3", location.String())
+}
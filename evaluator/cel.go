@@ -1,51 +1,109 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
+	"maps"
 	"reflect"
 	"strings"
 
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/ext"
 
+	"github.com/spacelift-io/celplate"
 	"github.com/spacelift-io/celplate/source"
 )
 
+var (
+	_ celplate.ValueEvaluator        = (*CEL)(nil)
+	_ celplate.ScopedEvaluator       = (*CEL)(nil)
+	_ celplate.CheckingEvaluator     = (*CEL)(nil)
+	_ celplate.TypeCheckingEvaluator = (*CEL)(nil)
+	_ celplate.ContextEvaluator      = (*CEL)(nil)
+)
+
+// interruptCheckFrequency is the number of iterations of comprehensions after
+// which the context of an evaluation is checked. CEL counts the iterations of
+// every comprehension separately, so anything but checking on every iteration
+// lets deeply nested comprehensions over short lists run on for long after the
+// context is done.
+const interruptCheckFrequency = 1
+
 var anyListType = reflect.TypeOf([]any{})
 var anyMapType = reflect.TypeOf(map[any]any{})
 
-// CEL is an implementation of Evaluator that uses CEL expressions.
+// CEL is an implementation of Evaluator that uses CEL expressions. It is safe
+// for concurrent use.
 type CEL struct {
 	env  *cel.Env
 	vars map[string]any
+
+	// declared holds the names of all declared variables, including those
+	// without values.
+	declared map[string]bool
+
+	limits Limits
+}
+
+// CELOption configures a CEL evaluator.
+type CELOption func(*celConfig)
+
+type celConfig struct {
+	types  map[string]*cel.Type
+	limits Limits
+}
+
+// WithTypes declares variables of the given types, which are then enforced
+// when expressions are compiled. Variables without data can only be used to
+// check expressions, while variables with data get the declared type instead
+// of a map of strings to any values.
+func WithTypes(types map[string]*cel.Type) CELOption {
+	return func(c *celConfig) {
+		maps.Copy(c.types, types)
+	}
 }
 
 // NewCEL returns a new instance of CEL evaluator.
-func NewCEL(data map[string]map[string]any) (*CEL, error) {
-	var envOpts []cel.EnvOption
+func NewCEL(data map[string]map[string]any, opts ...CELOption) (*CEL, error) {
+	config := celConfig{types: make(map[string]*cel.Type)}
 
 	vars := make(map[string]any)
 
 	for key, value := range data {
-		envOpts = append(
-			envOpts,
-			cel.Variable(key, cel.MapType(cel.StringType, cel.AnyType)),
-		)
+		config.types[key] = cel.MapType(cel.StringType, cel.AnyType)
 		vars[key] = value
 	}
 
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	var envOpts []cel.EnvOption
+
+	declared := make(map[string]bool)
+
+	for key, typ := range config.types {
+		envOpts = append(envOpts, cel.Variable(key, typ))
+		declared[key] = true
+	}
+
 	// There is a bunch of methods which isn't included in the default environment
 	// like `charAt`, `join`, `split`, etc. Let's add them too.
 	envOpts = append(envOpts, ext.Strings())
 
+	// Macro calls are kept, so that residual expressions are written back
+	// with macros rather than the comprehensions they expand to.
+	envOpts = append(envOpts, cel.EnableMacroCallTracking())
+
 	env, err := cel.NewEnv(envOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create environment: %w", err)
 	}
 
-	return &CEL{env, vars}, nil
+	return &CEL{env, vars, declared, config.limits}, nil
 }
 
 // Evaluate evaluates the given expression using Google CEL, and returns its
@@ -53,35 +111,158 @@ func NewCEL(data map[string]map[string]any) (*CEL, error) {
 //
 // It expects the final value to be one of types: "string", "int", "uint", "double", "bool".
 func (e *CEL) Evaluate(expression string) (string, error) {
-	ast, iss := e.env.Compile(expression)
+	return e.EvaluateContext(context.Background(), expression)
+}
 
-	if errors := iss.Errors(); len(errors) > 0 {
-		sourceErrors := &source.Errors{}
-
-		for _, err := range errors {
-			sourceErrors.Push(&source.Error{
-				Location: source.Location{
-					Line:   err.Location.Line(),
-					Column: err.Location.Column() + 1, // CEL columns are 0-based
-				},
-				Message: err.Message,
-			})
-		}
+// EvaluateContext works like Evaluate, but it interrupts the evaluation as
+// soon as the context is done, e.g. in the middle of a comprehension.
+func (e *CEL) EvaluateContext(ctx context.Context, expression string) (string, error) {
+	out, err := e.eval(ctx, expression)
+	if err != nil {
+		return "", err
+	}
 
-		return "", sourceErrors.ErrorOrNil()
+	rendered, err := e.attemptConversionToString(out)
+	if err != nil {
+		return "", err
 	}
 
-	program, err := e.env.Program(ast)
+	if err := e.limits.checkOutputSize(rendered); err != nil {
+		return "", err
+	}
+
+	return rendered, nil
+}
+
+// EvaluateValue evaluates the given expression using Google CEL, and returns
+// its result converted to a native Go value, plus an error, if any.
+//
+// Lists are converted to []any and maps to map[any]any, recursively. Other
+// values are returned as is, e.g. int64, string, bool or time.Time.
+func (e *CEL) EvaluateValue(expression string) (any, error) {
+	return e.EvaluateValueContext(context.Background(), expression)
+}
+
+// EvaluateValueContext works like EvaluateValue, but it interrupts the
+// evaluation as soon as the context is done.
+func (e *CEL) EvaluateValueContext(ctx context.Context, expression string) (any, error) {
+	out, err := e.eval(ctx, expression)
+	if err != nil {
+		return nil, err
+	}
+
+	return toNative(out)
+}
+
+// Check compiles and type-checks the given expression against the declared
+// variables, without evaluating it.
+func (e *CEL) Check(expression string) error {
+	_, err := e.compile(expression)
+	return err
+}
+
+// CheckType works like Check, but it also returns the type of the value of
+// the expression. Values of variables without declared types, as well as of
+// their fields, are dynamic.
+func (e *CEL) CheckType(expression string) (celplate.ValueType, error) {
+	ast, err := e.compile(expression)
+	if err != nil {
+		return "", err
+	}
+
+	switch typ := ast.OutputType(); typ.Kind() {
+	case types.DynKind, types.AnyKind, types.TypeParamKind:
+		return celplate.DynType, nil
+	case types.BoolKind:
+		return celplate.BoolType, nil
+	case types.ListKind:
+		return celplate.ListType, nil
+	case types.MapKind:
+		return celplate.MapType, nil
+	default:
+		return celplate.ValueType(typ.String()), nil
+	}
+}
+
+func (e *CEL) eval(ctx context.Context, expression string) (ref.Val, error) {
+	ast, err := e.compile(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append(e.limits.programOptions(), cel.InterruptCheckFrequency(interruptCheckFrequency))
+
+	program, err := e.env.Program(ast, opts...)
 	if err != nil {
-		return "", fmt.Errorf("failed to create expression evaluator %w", err)
+		return nil, fmt.Errorf("failed to create expression evaluator %w", err)
 	}
 
-	out, _, err := program.Eval(e.vars)
+	out, details, err := program.ContextEval(ctx, e.vars)
 	if err != nil {
-		return "", fmt.Errorf("failed to evaluate expression: %w", err)
+		return nil, e.limits.evaluationError(err, details)
 	}
 
-	return e.attemptConversionToString(out)
+	return out, nil
+}
+
+// compile parses and type-checks the expression, returning syntax and type
+// errors as source errors. Expressions breaching the limits are rejected.
+func (e *CEL) compile(expression string) (*cel.Ast, error) {
+	if err := e.limits.checkLength(expression); err != nil {
+		return nil, err
+	}
+
+	ast, iss := e.env.Compile(expression)
+	if err := issuesToErrors(expression, iss.Errors()); err != nil {
+		return nil, err
+	}
+
+	if err := e.limits.checkDepth(ast); err != nil {
+		return nil, err
+	}
+
+	return ast, nil
+}
+
+// issuesToErrors converts errors reported by CEL for the expression to source
+// errors, or returns nil if there are none.
+func issuesToErrors(expression string, errors []*common.Error) error {
+	sourceErrors := &source.Errors{}
+
+	for _, err := range errors {
+		sourceErrors.Push(&source.Error{
+			// CEL columns are 0-based.
+			Location: source.Locate(expression, err.Location.Line(), err.Location.Column()+1),
+			Message:  err.Message,
+		})
+	}
+
+	return sourceErrors.ErrorOrNil()
+}
+
+// WithVariables returns a copy of the evaluator which can also access the
+// given variables. New variables are declared with a dynamic type, while
+// existing variables keep their types and get new values.
+func (e *CEL) WithVariables(vars map[string]any) (celplate.Evaluator, error) {
+	var envOpts []cel.EnvOption
+
+	merged := maps.Clone(e.vars)
+	declared := maps.Clone(e.declared)
+
+	for key, value := range vars {
+		if !declared[key] {
+			envOpts = append(envOpts, cel.Variable(key, cel.DynType))
+			declared[key] = true
+		}
+		merged[key] = value
+	}
+
+	env, err := e.env.Extend(envOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extend environment: %w", err)
+	}
+
+	return &CEL{env, merged, declared, e.limits}, nil
 }
 
 // attemptConversionToString tries to convert the outcome of the expression to a string.
@@ -131,3 +312,58 @@ func (e *CEL) attemptConversionToString(out ref.Val) (string, error) {
 		return converted.Value().(string), nil
 	}
 }
+
+// toNative converts the outcome of the expression to a native Go value.
+func toNative(out ref.Val) (any, error) {
+	switch out.Type() {
+	case types.ListType:
+		asList, err := out.ConvertToNative(anyListType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to cast value %q of type %s to a list", out.Value(), out.Type().TypeName())
+		}
+
+		items := asList.([]any)
+		for ix, item := range items {
+			if items[ix], err = itemToNative(item); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+
+	case types.MapType:
+		asMap, err := out.ConvertToNative(anyMapType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to cast value %q of type %s to a map", out.Value(), out.Type().TypeName())
+		}
+
+		items := make(map[any]any)
+		for key, item := range asMap.(map[any]any) {
+			if key, err = itemToNative(key); err != nil {
+				return nil, err
+			}
+			if items[key], err = itemToNative(item); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+
+	case types.ErrType:
+		return nil, out.Value().(error)
+	}
+
+	return out.Value(), nil
+}
+
+// itemToNative converts an item of a list or a map to a native Go value.
+// Items which already are native Go values are normalised the way CEL sees
+// them, e.g. int becomes int64.
+func itemToNative(item any) (any, error) {
+	val, ok := item.(ref.Val)
+	if !ok {
+		val = types.DefaultTypeAdapter.NativeToValue(item)
+	}
+
+	return toNative(val)
+}
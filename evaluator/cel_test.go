@@ -1,12 +1,15 @@
 package evaluator_test
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"github.com/google/cel-go/cel"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/spacelift-io/celplate"
 	"github.com/spacelift-io/celplate/evaluator"
 )
 
@@ -109,6 +112,12 @@ func TestCEL_Evaluate(t *testing.T) {
 			wantErr:     true,
 			errContains: "line 1, column 1: undeclared reference to 'unknown' (in container '')",
 		},
+		{
+			name:        "multi-line expression reports the line of the error",
+			expression:  "input.foo +\n  unknown.var",
+			wantErr:     true,
+			errContains: "line 2, column 3: undeclared reference to 'unknown' (in container '')",
+		},
 		{
 			name:       "join macro works with string lists",
 			expression: `['1', '2'].join(', ')`,
@@ -153,3 +162,189 @@ func TestCEL_Evaluate(t *testing.T) {
 		})
 	}
 }
+
+func TestCEL_EvaluateValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       any
+		wantErr    bool
+	}{
+		{
+			name:       "bool",
+			expression: `context.boolean && input.foo == "bar"`,
+			want:       true,
+		},
+		{
+			name:       "int",
+			expression: `context.signed`,
+			want:       int64(2),
+		},
+		{
+			name:       "string",
+			expression: `input.foo`,
+			want:       "bar",
+		},
+		{
+			name:       "timestamp",
+			expression: `context.time`,
+			want:       time.Unix(1666960429, 0).UTC(),
+		},
+		{
+			name:       "nested list",
+			expression: `[1, ["a", true], {"b": 2.5}]`,
+			want:       []any{int64(1), []any{"a", true}, map[any]any{"b": 2.5}},
+		},
+		{
+			name:       "empty list",
+			expression: `[]`,
+			want:       []any{},
+		},
+		{
+			name:       "map from data",
+			expression: `complex.intmap`,
+			want:       map[any]any{int64(1): int64(2)},
+		},
+		{
+			name:       "evaluation error",
+			expression: `input.missing`,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cel := newTestCEL(t)
+			result, err := cel.EvaluateValue(tt.expression)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Nil(t, result)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, result)
+		})
+	}
+}
+
+func TestCEL_WithVariables(t *testing.T) {
+	cel := newTestCEL(t)
+
+	scoped, err := cel.WithVariables(map[string]any{
+		"item":  map[string]any{"name": "first"},
+		"index": 1,
+	})
+	require.NoError(t, err)
+
+	result, err := scoped.Evaluate(`item.name + "-" + string(index) + "-" + input.foo`)
+	require.NoError(t, err)
+	assert.Equal(t, "first-1-bar", result)
+
+	nested, err := scoped.(*evaluator.CEL).WithVariables(map[string]any{"index": 2})
+	require.NoError(t, err)
+
+	result, err = nested.Evaluate(`item.name + "-" + string(index)`)
+	require.NoError(t, err)
+	assert.Equal(t, "first-2", result)
+
+	_, err = cel.Evaluate(`item.name`)
+	assert.ErrorContains(t, err, "undeclared reference to 'item'")
+}
+
+func TestCEL_Check(t *testing.T) {
+	sut, err := evaluator.NewCEL(nil, evaluator.WithTypes(map[string]*cel.Type{
+		"inputs": cel.MapType(cel.StringType, cel.StringType),
+		"count":  cel.IntType,
+	}))
+	require.NoError(t, err)
+
+	assert.NoError(t, sut.Check(`inputs.region + "-" + string(count)`))
+
+	err = sut.Check("inputs.region + count")
+	assert.EqualError(t, err, "line 1, column 15: found no matching overload for '_+_' applied to '(string, int)'")
+
+	err = sut.Check("missing")
+	assert.EqualError(t, err, "line 1, column 1: undeclared reference to 'missing' (in container '')")
+
+	_, err = sut.Evaluate("count")
+	assert.ErrorContains(t, err, "no such attribute")
+}
+
+func TestCEL_CheckType(t *testing.T) {
+	sut, err := evaluator.NewCEL(map[string]map[string]any{"data": nil}, evaluator.WithTypes(map[string]*cel.Type{
+		"inputs": cel.MapType(cel.StringType, cel.StringType),
+		"count":  cel.IntType,
+	}))
+	require.NoError(t, err)
+
+	tests := map[string]celplate.ValueType{
+		`count > 1`:                   celplate.BoolType,
+		`[count]`:                     celplate.ListType,
+		`inputs`:                      celplate.MapType,
+		`data.anything`:               celplate.DynType,
+		`dyn(count)`:                  celplate.DynType,
+		`inputs.region`:               "string",
+		`count + 1`:                   "int",
+		`inputs.all(k, k.size() > 1)`: celplate.BoolType,
+	}
+
+	for expression, want := range tests {
+		t.Run(expression, func(t *testing.T) {
+			got, err := sut.CheckType(expression)
+
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+
+	_, err = sut.CheckType("missing")
+	assert.EqualError(t, err, "line 1, column 1: undeclared reference to 'missing' (in container '')")
+}
+
+func TestCEL_WithTypes_Data(t *testing.T) {
+	sut, err := evaluator.NewCEL(
+		map[string]map[string]any{"inputs": {"count": 2}},
+		evaluator.WithTypes(map[string]*cel.Type{"inputs": cel.MapType(cel.StringType, cel.IntType)}),
+	)
+	require.NoError(t, err)
+
+	result, err := sut.Evaluate("inputs.count + 1")
+	require.NoError(t, err)
+	assert.Equal(t, "3", result)
+
+	assert.Error(t, sut.Check(`inputs.count + "a"`))
+
+	scoped, err := sut.WithVariables(map[string]any{"inputs": map[string]any{"count": 3}})
+	require.NoError(t, err)
+	assert.Error(t, scoped.(*evaluator.CEL).Check(`inputs.count + "a"`))
+}
+
+func TestCEL_EvaluateContext_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	list := "[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]"
+
+	_, err := newTestCEL(t).EvaluateContext(ctx, list+".map(x, "+list+".map(y, "+list+".map(z, x * y * z)))")
+	assert.ErrorContains(t, err, "operation interrupted")
+
+	_, err = newTestCEL(t).EvaluateValueContext(ctx, list+".all(x, "+list+".all(y, "+list+".all(z, x * y * z > 0)))")
+	assert.ErrorContains(t, err, "operation interrupted")
+}
+
+func TestCEL_EvaluateContext_DeeplyNested(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Seven levels of comprehensions over ten items each would take seconds.
+	expression := "1"
+	for _, variable := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		expression = "[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(" + variable + ", " + expression + ")"
+	}
+
+	start := time.Now()
+	_, err := newTestCEL(t).EvaluateContext(ctx, expression)
+
+	assert.ErrorContains(t, err, "operation interrupted")
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,154 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/interpreter"
+
+	"github.com/spacelift-io/celplate"
+)
+
+// Limits bounds the resources spent on every expression, e.g. when templates
+// are written by untrusted users. Zero values mean no limit.
+type Limits struct {
+	// Cost is the maximum runtime cost of evaluating an expression, as
+	// tracked by CEL. It's roughly the number of operations performed,
+	// with iterations of comprehensions included.
+	Cost uint64
+
+	// ExpressionLength is the maximum length of an expression, in characters.
+	ExpressionLength int
+
+	// Depth is the maximum depth of the syntax tree of an expression, e.g.
+	// 3 for `a + (b * c)`. Macros, like map, are expanded by CEL before
+	// their depth is measured, so they count as a few levels.
+	Depth int
+
+	// OutputSize is the maximum size of the rendered result of an expression,
+	// in bytes.
+	OutputSize int
+}
+
+// LimitError is the error of an expression breaching a limit. It's the same
+// type as the error of the scanner's output limit.
+type LimitError = celplate.LimitError
+
+// WithLimits makes the evaluator enforce the given limits. Expressions
+// breaching them fail with a *LimitError describing the breached limit.
+func WithLimits(limits Limits) CELOption {
+	return func(c *celConfig) {
+		c.limits = limits
+	}
+}
+
+// checkLength returns an error if the expression is longer than allowed.
+func (l Limits) checkLength(expression string) error {
+	if l.ExpressionLength == 0 {
+		return nil
+	}
+
+	if length := utf8.RuneCountInString(expression); length > l.ExpressionLength {
+		return &LimitError{Limit: celplate.ExpressionLengthLimit, Value: uint64(length), Max: uint64(l.ExpressionLength)}
+	}
+
+	return nil
+}
+
+// checkDepth returns an error if the syntax tree of the expression is deeper
+// than allowed.
+func (l Limits) checkDepth(ast *cel.Ast) error {
+	if l.Depth == 0 {
+		return nil
+	}
+
+	if depth := exprDepth(ast.NativeRep().Expr()); depth > l.Depth {
+		return &LimitError{Limit: celplate.DepthLimit, Value: uint64(depth), Max: uint64(l.Depth)}
+	}
+
+	return nil
+}
+
+// checkOutputSize returns an error if the rendered result of an expression is
+// larger than allowed.
+func (l Limits) checkOutputSize(output string) error {
+	if l.OutputSize == 0 || len(output) <= l.OutputSize {
+		return nil
+	}
+
+	return &LimitError{Limit: celplate.ResultSizeLimit, Value: uint64(len(output)), Max: uint64(l.OutputSize)}
+}
+
+// programOptions returns the options enforcing the limits at runtime.
+func (l Limits) programOptions() []cel.ProgramOption {
+	if l.Cost == 0 {
+		return nil
+	}
+
+	return []cel.ProgramOption{cel.CostLimit(l.Cost)}
+}
+
+// evaluationError describes the error returned by CEL when evaluating an
+// expression, given the details of the evaluation, if any.
+func (l Limits) evaluationError(err error, details *cel.EvalDetails) error {
+	var cancelled interpreter.EvalCancelledError
+	if errors.As(err, &cancelled) && cancelled.Cause == interpreter.CostLimitExceeded {
+		limitErr := &LimitError{Limit: celplate.CostLimit, Max: l.Cost}
+		if details != nil && details.ActualCost() != nil {
+			limitErr.Value = *details.ActualCost()
+		}
+		return limitErr
+	}
+
+	return fmt.Errorf("failed to evaluate expression: %w", err)
+}
+
+// exprDepth returns the depth of the syntax tree of the expression.
+func exprDepth(expr celast.Expr) int {
+	depth := 0
+	for _, child := range exprChildren(expr) {
+		depth = max(depth, exprDepth(child))
+	}
+
+	return depth + 1
+}
+
+// exprChildren returns the direct subexpressions of the expression.
+func exprChildren(expr celast.Expr) []celast.Expr {
+	var children []celast.Expr
+
+	switch expr.Kind() {
+	case celast.SelectKind:
+		children = []celast.Expr{expr.AsSelect().Operand()}
+	case celast.CallKind:
+		call := expr.AsCall()
+		if call.IsMemberFunction() {
+			children = append(children, call.Target())
+		}
+		children = append(children, call.Args()...)
+	case celast.ListKind:
+		children = expr.AsList().Elements()
+	case celast.MapKind:
+		for _, entry := range expr.AsMap().Entries() {
+			children = append(children, entry.AsMapEntry().Key(), entry.AsMapEntry().Value())
+		}
+	case celast.StructKind:
+		for _, field := range expr.AsStruct().Fields() {
+			children = append(children, field.AsStructField().Value())
+		}
+	case celast.ComprehensionKind:
+		comprehension := expr.AsComprehension()
+		children = []celast.Expr{
+			comprehension.IterRange(),
+			comprehension.AccuInit(),
+			comprehension.LoopCondition(),
+			comprehension.LoopStep(),
+			comprehension.Result(),
+		}
+	}
+
+	return children
+}
@@ -0,0 +1,115 @@
+package evaluator_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func TestCEL_WithLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     evaluator.Limits
+		expression string
+		want       string
+		wantErr    string
+		wantLimit  evaluator.LimitError
+	}{
+		{
+			name:       "within limits",
+			limits:     evaluator.Limits{Cost: 100, ExpressionLength: 20, Depth: 4, OutputSize: 2},
+			expression: `1 + (2 * input.num)`,
+			want:       "13",
+		},
+		{
+			name:       "cost",
+			limits:     evaluator.Limits{Cost: 100},
+			expression: `[1, 2, 3, 4, 5].map(x, [1, 2, 3, 4, 5].map(y, [1, 2, 3, 4, 5].map(z, x + y + z))).size()`,
+			wantErr:    "expression exceeds the cost limit of 100",
+			wantLimit:  evaluator.LimitError{Limit: celplate.CostLimit, Max: 100},
+		},
+		{
+			name:       "expression length",
+			limits:     evaluator.Limits{ExpressionLength: 10},
+			expression: `"€€€€€€€€€€"`,
+			wantErr:    "expression is 12 characters long, exceeding the limit of 10 characters",
+			wantLimit:  evaluator.LimitError{Limit: celplate.ExpressionLengthLimit, Value: 12, Max: 10},
+		},
+		{
+			name:       "depth",
+			limits:     evaluator.Limits{Depth: 4},
+			expression: `1 + (2 * (3 - input.num))`,
+			wantErr:    "expression is nested 5 levels deep, exceeding the limit of 4 levels",
+			wantLimit:  evaluator.LimitError{Limit: celplate.DepthLimit, Value: 5, Max: 4},
+		},
+		{
+			name:       "depth of macros",
+			limits:     evaluator.Limits{Depth: 3},
+			expression: `[1].map(x, x)`,
+			wantErr:    "expression is nested 4 levels deep, exceeding the limit of 3 levels",
+			wantLimit:  evaluator.LimitError{Limit: celplate.DepthLimit, Value: 4, Max: 3},
+		},
+		{
+			name:       "output size",
+			limits:     evaluator.Limits{OutputSize: 5},
+			expression: `"abc" + input.foo`,
+			wantErr:    "result is 6 bytes long, exceeding the limit of 5 bytes",
+			wantLimit:  evaluator.LimitError{Limit: celplate.ResultSizeLimit, Value: 6, Max: 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut, err := evaluator.NewCEL(map[string]map[string]any{
+				"input": {"foo": "bar", "num": 6},
+			}, evaluator.WithLimits(tt.limits))
+			require.NoError(t, err)
+
+			got, err := sut.Evaluate(tt.expression)
+
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+
+				var limitErr *evaluator.LimitError
+				require.ErrorAs(t, err, &limitErr)
+				assert.Equal(t, tt.wantLimit.Limit, limitErr.Limit)
+				assert.Equal(t, tt.wantLimit.Max, limitErr.Max)
+
+				// The actual cost is only known to be over the limit.
+				if tt.wantLimit.Limit == celplate.CostLimit {
+					assert.Greater(t, limitErr.Value, limitErr.Max)
+				} else {
+					assert.Equal(t, tt.wantLimit.Value, limitErr.Value)
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCEL_WithLimits_Check(t *testing.T) {
+	sut, err := evaluator.NewCEL(nil, evaluator.WithLimits(evaluator.Limits{ExpressionLength: 5, Depth: 1}))
+	require.NoError(t, err)
+
+	assert.NoError(t, sut.Check("1"))
+	assert.EqualError(t, sut.Check("1 + 2"), "expression is nested 2 levels deep, exceeding the limit of 1 levels")
+	assert.EqualError(t, sut.Check("1 + 23"), "expression is 6 characters long, exceeding the limit of 5 characters")
+}
+
+func TestCEL_WithLimits_WithVariables(t *testing.T) {
+	sut, err := evaluator.NewCEL(nil, evaluator.WithLimits(evaluator.Limits{OutputSize: 3}))
+	require.NoError(t, err)
+
+	scoped, err := sut.WithVariables(map[string]any{"item": "abcd"})
+	require.NoError(t, err)
+
+	_, err = scoped.Evaluate("item")
+	assert.EqualError(t, err, "result is 4 bytes long, exceeding the limit of 3 bytes")
+}
@@ -0,0 +1,213 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+
+	"github.com/spacelift-io/celplate"
+)
+
+var _ celplate.PartialEvaluator = (*CEL)(nil)
+
+// Residual evaluates the parts of the given expression which only refer to
+// variables with values, if the expression also refers to declared variables
+// without values. The resulting expression has the evaluated parts replaced by
+// constants, e.g. `context.env + "-" + inputs.name` becomes
+// `"prod-" + inputs.name`.
+//
+// Parts which cannot be evaluated in place, like the bodies of macros
+// iterating over unknown lists, have the values of the variables they refer to
+// inlined as constants instead, e.g. `inputs.list.map(x, x + context.env)`
+// becomes `inputs.list.map(x, x + "prod")`. Expressions whose values cannot be
+// written as constants are reported as errors.
+func (e *CEL) Residual(expression string) (string, bool, error) {
+	if !e.hasUnknowns() {
+		return "", false, nil
+	}
+
+	ast, err := e.compile(expression)
+	if err != nil {
+		return "", false, err
+	}
+
+	opts := append(e.limits.programOptions(), cel.EvalOptions(cel.OptTrackState, cel.OptPartialEval))
+
+	program, err := e.env.Program(ast, opts...)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create expression evaluator %w", err)
+	}
+
+	activation, err := e.env.PartialVars(e.vars)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create activation: %w", err)
+	}
+
+	// Errors are left for the evaluation of the expression to report.
+	out, details, err := program.Eval(activation)
+	if err != nil || !types.IsUnknown(out) {
+		return "", false, nil
+	}
+
+	e.inlineValues(ast.NativeRep().Expr(), nil, details.State())
+
+	if residual, err := e.env.ResidualAst(ast, details); err == nil {
+		if text, err := cel.AstToString(residual); err == nil && !e.refersToValues(text) {
+			return text, true, nil
+		}
+	}
+
+	if !e.refersToValues(expression) {
+		return strings.TrimSpace(expression), true, nil
+	}
+
+	return "", false, errors.New("failed to partially evaluate expression, variables with values cannot be replaced in it")
+}
+
+// inlineValues records the values of the largest parts of the expression which
+// only refer to variables with values, skipping the given variables bound by
+// macros, so that they are replaced by constants in the residual expression.
+func (e *CEL) inlineValues(expr celast.Expr, bound []string, state interpreter.EvalState) {
+	if e.onlyRefersToValues(expr, bound) {
+		if value, err := e.evalExpr(expr); err == nil {
+			state.SetValue(expr.ID(), value)
+		}
+		return
+	}
+
+	if expr.Kind() != celast.ComprehensionKind {
+		for _, child := range exprChildren(expr) {
+			e.inlineValues(child, bound, state)
+		}
+		return
+	}
+
+	comprehension := expr.AsComprehension()
+	e.inlineValues(comprehension.IterRange(), bound, state)
+
+	inner := append(slices.Clone(bound), comprehension.IterVar(), comprehension.AccuVar())
+	e.inlineValues(comprehension.AccuInit(), inner, state)
+	e.inlineValues(comprehension.LoopCondition(), inner, state)
+	e.inlineValues(comprehension.LoopStep(), inner, state)
+	e.inlineValues(comprehension.Result(), inner, state)
+}
+
+// onlyRefersToValues returns whether the expression refers to any variables,
+// all of which have values and none of which are among the given variables
+// bound by macros.
+func (e *CEL) onlyRefersToValues(expr celast.Expr, bound []string) bool {
+	references := 0
+
+	var visit func(expr celast.Expr, bound []string) bool
+	visit = func(expr celast.Expr, bound []string) bool {
+		if expr.Kind() == celast.IdentKind {
+			name := expr.AsIdent()
+			if _, ok := e.vars[name]; !ok || slices.Contains(bound, name) {
+				return false
+			}
+			references++
+			return true
+		}
+
+		if expr.Kind() == celast.ComprehensionKind {
+			comprehension := expr.AsComprehension()
+			inner := append(slices.Clone(bound), comprehension.IterVar(), comprehension.AccuVar())
+
+			return visit(comprehension.IterRange(), bound) &&
+				visit(comprehension.AccuInit(), inner) &&
+				visit(comprehension.LoopCondition(), inner) &&
+				visit(comprehension.LoopStep(), inner) &&
+				visit(comprehension.Result(), inner)
+		}
+
+		for _, child := range exprChildren(expr) {
+			if !visit(child, bound) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return visit(expr, bound) && references > 0
+}
+
+// evalExpr evaluates a part of a parsed expression.
+func (e *CEL) evalExpr(expr celast.Expr) (ref.Val, error) {
+	parsed, err := celast.ExprToProto(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := e.env.Program(cel.ParsedExprToAst(&exprpb.ParsedExpr{Expr: parsed}), e.limits.programOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	out, _, err := program.Eval(e.vars)
+
+	return out, err
+}
+
+// WithUnknowns returns a copy of the evaluator for which the given variables
+// are declared, but have no values, so that they are left in the residual
+// expressions.
+func (e *CEL) WithUnknowns(names ...string) (celplate.Evaluator, error) {
+	var envOpts []cel.EnvOption
+
+	vars := maps.Clone(e.vars)
+	declared := maps.Clone(e.declared)
+
+	for _, name := range names {
+		if !declared[name] {
+			envOpts = append(envOpts, cel.Variable(name, cel.DynType))
+			declared[name] = true
+		}
+		delete(vars, name)
+	}
+
+	env, err := e.env.Extend(envOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extend environment: %w", err)
+	}
+
+	return &CEL{env, vars, declared, e.limits}, nil
+}
+
+// hasUnknowns returns whether any declared variable has no value.
+func (e *CEL) hasUnknowns() bool {
+	for name := range e.declared {
+		if _, ok := e.vars[name]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refersToValues returns whether the expression refers to any variable with
+// a value, which is also assumed if it cannot be parsed.
+func (e *CEL) refersToValues(expression string) bool {
+	references, err := e.References(expression)
+	if err != nil {
+		return true
+	}
+
+	for _, ref := range references {
+		variable, _, _ := strings.Cut(ref.Path, ".")
+		if _, ok := e.vars[variable]; ok {
+			return true
+		}
+	}
+
+	return false
+}
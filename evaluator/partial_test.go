@@ -0,0 +1,141 @@
+package evaluator_test
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate/evaluator"
+)
+
+func newPartialCEL(t *testing.T) *evaluator.CEL {
+	t.Helper()
+	sut, err := evaluator.NewCEL(
+		map[string]map[string]any{"context": {"env": "prod", "list": []int{1, 2}}},
+		evaluator.WithTypes(map[string]*cel.Type{"inputs": cel.MapType(cel.StringType, cel.DynType)}),
+	)
+	require.NoError(t, err)
+	return sut
+}
+
+func TestCEL_Residual(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       string
+		unknown    bool
+		wantErr    string
+	}{
+		{
+			name:       "known",
+			expression: `context.env + "-1"`,
+		},
+		{
+			name:       "unknown",
+			expression: `context.env + "-" + inputs.name`,
+			want:       `"prod-" + inputs.name`,
+			unknown:    true,
+		},
+		{
+			name:       "short-circuited",
+			expression: `context.env == "dev" || inputs.enabled`,
+			want:       `inputs.enabled`,
+			unknown:    true,
+		},
+		{
+			name:       "list",
+			expression: `context.list + inputs.list`,
+			want:       `[1, 2] + inputs.list`,
+			unknown:    true,
+		},
+		{
+			name:       "macro over unknown values",
+			expression: ` inputs.list.map(x, x * 2) `,
+			want:       `inputs.list.map(x, x * 2)`,
+			unknown:    true,
+		},
+		{
+			name:       "macro over both",
+			expression: `inputs.list.map(x, x + context.list[0])`,
+			want:       `inputs.list.map(x, x + 1)`,
+			unknown:    true,
+		},
+		{
+			name:       "macro over both with a whole variable",
+			expression: `inputs.list.filter(x, x in context.list && string(x) != context.env)`,
+			want:       `inputs.list.filter(x, x in [1, 2] && string(x) != "prod")`,
+			unknown:    true,
+		},
+		{
+			name:       "nested macros over unknown values",
+			expression: `inputs.list.map(x, inputs.other.all(y, y != x + context.list[1]))`,
+			want:       `inputs.list.map(x, inputs.other.all(y, y != x + 2))`,
+			unknown:    true,
+		},
+		{
+			name:       "macro variable shadowing variable with value",
+			expression: `inputs.list.map(context, context * 2)`,
+			want:       `inputs.list.map(context, context * 2)`,
+			unknown:    true,
+		},
+		{
+			name:       "macro over both with evaluation error",
+			expression: `inputs.list.map(x, x + context.missing)`,
+			wantErr:    "failed to partially evaluate expression, variables with values cannot be replaced in it",
+		},
+		{
+			name:       "evaluation error",
+			expression: `context.missing + inputs.name`,
+		},
+		{
+			name:       "syntax error",
+			expression: `inputs.`,
+			wantErr:    "line 1, column 8: Syntax error: no viable alternative at input '.'",
+		},
+	}
+
+	sut := newPartialCEL(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			residual, unknown, err := sut.Residual(tt.expression)
+
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.unknown, unknown)
+			assert.Equal(t, tt.want, residual)
+		})
+	}
+}
+
+func TestCEL_Residual_NoUnknowns(t *testing.T) {
+	residual, unknown, err := newTestCEL(t).Residual("input.foo")
+
+	require.NoError(t, err)
+	assert.False(t, unknown)
+	assert.Empty(t, residual)
+}
+
+func TestCEL_WithUnknowns(t *testing.T) {
+	scoped, err := newPartialCEL(t).WithVariables(map[string]any{"item": "a"})
+	require.NoError(t, err)
+
+	unknown, err := scoped.(*evaluator.CEL).WithUnknowns("item", "other", "context")
+	require.NoError(t, err)
+
+	residual, ok, err := unknown.(*evaluator.CEL).Residual(`item + other + context.env`)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "item + other + context.env", residual)
+
+	residual, ok, err = scoped.(*evaluator.CEL).Residual(`item + inputs.name`)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, `"a" + inputs.name`, residual)
+}
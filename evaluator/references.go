@@ -0,0 +1,131 @@
+package evaluator
+
+import (
+	"slices"
+	"strings"
+
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
+)
+
+var _ celplate.ReferencingEvaluator = (*CEL)(nil)
+
+// References parses the given expression, and returns the variables and the
+// fields of variables it selects, like "inputs.region" in
+// `inputs.region.upperAscii()`. Fields accessed with an index of a constant
+// string, like inputs["region"], are included in the path as well. Variables
+// don't need to be declared, while variables bound by macros are skipped.
+func (e *CEL) References(expression string) ([]celplate.Reference, error) {
+	ast, iss := e.env.Parse(expression)
+	if err := issuesToErrors(expression, iss.Errors()); err != nil {
+		return nil, err
+	}
+
+	native := ast.NativeRep()
+	finder := &referenceFinder{expression: expression, info: native.SourceInfo()}
+	finder.visit(native.Expr(), nil)
+
+	slices.SortStableFunc(finder.references, func(a, b celplate.Reference) int {
+		return a.Location.Offset - b.Location.Offset
+	})
+
+	return finder.references, nil
+}
+
+// referenceFinder walks the AST of an expression, gathering its references.
+type referenceFinder struct {
+	expression string
+	info       *celast.SourceInfo
+	references []celplate.Reference
+}
+
+// visit gathers the references of the expression, skipping the given variables
+// bound by macros.
+func (f *referenceFinder) visit(expr celast.Expr, bound []string) {
+	if path, root, ok := selectionPath(expr); ok {
+		if !slices.Contains(bound, path[0]) {
+			f.add(strings.Join(path, "."), root)
+		}
+		return
+	}
+
+	switch expr.Kind() {
+	case celast.SelectKind:
+		f.visit(expr.AsSelect().Operand(), bound)
+	case celast.CallKind:
+		call := expr.AsCall()
+		if call.IsMemberFunction() {
+			f.visit(call.Target(), bound)
+		}
+		for _, arg := range call.Args() {
+			f.visit(arg, bound)
+		}
+	case celast.ListKind:
+		for _, element := range expr.AsList().Elements() {
+			f.visit(element, bound)
+		}
+	case celast.MapKind:
+		for _, entry := range expr.AsMap().Entries() {
+			f.visit(entry.AsMapEntry().Key(), bound)
+			f.visit(entry.AsMapEntry().Value(), bound)
+		}
+	case celast.StructKind:
+		for _, field := range expr.AsStruct().Fields() {
+			f.visit(field.AsStructField().Value(), bound)
+		}
+	case celast.ComprehensionKind:
+		comprehension := expr.AsComprehension()
+		f.visit(comprehension.IterRange(), bound)
+
+		inner := append(slices.Clone(bound), comprehension.IterVar(), comprehension.AccuVar())
+		f.visit(comprehension.AccuInit(), inner)
+		f.visit(comprehension.LoopCondition(), inner)
+		f.visit(comprehension.LoopStep(), inner)
+		f.visit(comprehension.Result(), inner)
+	}
+}
+
+// add records the reference whose root identifier is the given expression.
+func (f *referenceFinder) add(path string, root celast.Expr) {
+	location := f.info.GetStartLocation(root.ID())
+
+	f.references = append(f.references, celplate.Reference{
+		Path: path,
+		// CEL columns are 0-based.
+		Location: source.Locate(f.expression, location.Line(), location.Column()+1),
+	})
+}
+
+// selectionPath returns the names of the identifier and the fields selected by
+// the expression, along with the identifier, if the expression is nothing but
+// a chain of field selections.
+func selectionPath(expr celast.Expr) ([]string, celast.Expr, bool) {
+	switch expr.Kind() {
+	case celast.IdentKind:
+		return []string{expr.AsIdent()}, expr, true
+
+	case celast.SelectKind:
+		path, root, ok := selectionPath(expr.AsSelect().Operand())
+		return append(path, expr.AsSelect().FieldName()), root, ok
+
+	case celast.CallKind:
+		call := expr.AsCall()
+		if call.FunctionName() != operators.Index || len(call.Args()) != 2 {
+			return nil, nil, false
+		}
+
+		index := call.Args()[1]
+		if index.Kind() != celast.LiteralKind || index.AsLiteral().Type() != types.StringType {
+			return nil, nil, false
+		}
+
+		path, root, ok := selectionPath(call.Args()[0])
+		return append(path, index.AsLiteral().Value().(string)), root, ok
+	}
+
+	return nil, nil, false
+}
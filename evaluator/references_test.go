@@ -0,0 +1,96 @@
+package evaluator_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestCEL_References(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       []string
+	}{
+		{
+			name:       "identifier",
+			expression: "input",
+			want:       []string{"input"},
+		},
+		{
+			name:       "selections",
+			expression: `input.foo + context.user.name`,
+			want:       []string{"input.foo", "context.user.name"},
+		},
+		{
+			name:       "functions",
+			expression: `input.foo.upperAscii() + string(size(input.bar))`,
+			want:       []string{"input.foo", "input.bar"},
+		},
+		{
+			name:       "indexes",
+			expression: `input["foo"] + input.list[0].name + input[context.key]`,
+			want:       []string{"input.foo", "input.list", "input", "context.key"},
+		},
+		{
+			name:       "presence tests",
+			expression: `has(input.foo) ? input.foo : "default"`,
+			want:       []string{"input.foo", "input.foo"},
+		},
+		{
+			name:       "macros",
+			expression: `input.items.map(item, item.name + input.suffix).exists(x, x == "a")`,
+			want:       []string{"input.items", "input.suffix"},
+		},
+		{
+			name:       "literals",
+			expression: `[1, input.a, {"key": input.b}]`,
+			want:       []string{"input.a", "input.b"},
+		},
+		{
+			name:       "undeclared variables",
+			expression: `missing.field`,
+			want:       []string{"missing.field"},
+		},
+	}
+
+	cel := newTestCEL(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			references, err := cel.References(tt.expression)
+			require.NoError(t, err)
+
+			var paths []string
+			for _, ref := range references {
+				paths = append(paths, ref.Path)
+			}
+			assert.Equal(t, tt.want, paths)
+		})
+	}
+}
+
+func TestCEL_References_Locations(t *testing.T) {
+	references, err := newTestCEL(t).References("'é' +\n  input.foo")
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Reference{
+		{Path: "input.foo", Location: source.Location{Index: 8, Line: 2, Column: 3, Offset: 9, UTF16Column: 3}},
+	}, references)
+}
+
+func TestCEL_References_SyntaxError(t *testing.T) {
+	_, err := newTestCEL(t).References("input.")
+
+	assert.EqualError(t, err, "line 1, column 7: Syntax error: no viable alternative at input '.'")
+}
+
+func TestCEL_References_OptionalSyntax(t *testing.T) {
+	_, err := newTestCEL(t).References("input.?foo")
+
+	assert.ErrorContains(t, err, "unsupported syntax '.?'")
+}
@@ -0,0 +1,211 @@
+package celplate
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// expressionLexer follows the CEL syntax of an expression while it's being
+// scanned, keeping track of string literals and nested brackets. This way
+// the closing delimiter is only recognised outside of them.
+type expressionLexer struct {
+	// depth is the number of currently open brackets.
+	depth int
+
+	// quote is the quote sequence which opened the current string literal,
+	// or an empty string outside of string literals.
+	quote string
+
+	// raw is set for raw string literals, which do not support escaping.
+	raw bool
+
+	// escaped is set when the previous character was an escaping backslash.
+	escaped bool
+
+	// length is the number of characters in the current string literal.
+	length int
+
+	// closingQuotes is the number of consecutive quote characters seen in the
+	// current triple-quoted string literal.
+	closingQuotes int
+
+	// emptyQuote is the quote character of an empty string literal which was
+	// just closed. If it's directly followed by another quote character of the
+	// same kind, it becomes the opening of a triple-quoted string literal.
+	emptyQuote rune
+	emptyRaw   bool
+}
+
+// captures returns whether the given character is a part of the expression
+// regardless of the closing delimiter, because it's either inside a string
+// literal or a bracket, or it opens a triple-quoted string literal.
+func (l *expressionLexer) captures(char rune) bool {
+	return l.quote != "" || l.depth > 0 || (l.emptyQuote != 0 && l.emptyQuote == char)
+}
+
+// atTopLevel returns whether the lexer is outside of any string literal
+// and bracket.
+func (l *expressionLexer) atTopLevel() bool {
+	return l.quote == "" && l.depth == 0
+}
+
+// advance moves the lexer past the given character, preceded by the given
+// part of the expression.
+func (l *expressionLexer) advance(char rune, preceding []byte) {
+	if l.quote != "" {
+		l.advanceString(char)
+		return
+	}
+
+	if quote := l.emptyQuote; quote != 0 {
+		l.emptyQuote = 0
+
+		if char == quote {
+			l.openString(strings.Repeat(string(quote), 3), l.emptyRaw)
+			return
+		}
+	}
+
+	switch char {
+	case '\'', '"':
+		l.openString(string(char), isRawPrefix(preceding))
+	case '(', '[', '{':
+		l.depth++
+	case ')', ']', '}':
+		// Unbalanced brackets are left for the evaluator to report.
+		if l.depth > 0 {
+			l.depth--
+		}
+	}
+}
+
+func (l *expressionLexer) openString(quote string, raw bool) {
+	l.quote = quote
+	l.raw = raw
+	l.length = 0
+	l.closingQuotes = 0
+}
+
+func (l *expressionLexer) advanceString(char rune) {
+	quote := rune(l.quote[0])
+
+	switch {
+	case l.escaped:
+		l.escaped = false
+	case char == '\\' && !l.raw:
+		l.escaped = true
+	case char == quote && len(l.quote) == 1:
+		if l.length == 0 {
+			l.emptyQuote, l.emptyRaw = quote, l.raw
+		}
+		l.quote = ""
+		return
+	case char == quote:
+		if l.closingQuotes++; l.closingQuotes == len(l.quote) {
+			l.quote = ""
+		}
+		return
+	}
+
+	l.closingQuotes = 0
+	l.length++
+}
+
+// isRawPrefix returns whether the expression preceding a quote ends with
+// a raw string literal prefix, like r'...' or br'...'.
+func isRawPrefix(preceding []byte) bool {
+	start := len(preceding)
+	for start > 0 && isIdentifierChar(rune(preceding[start-1])) {
+		start--
+	}
+
+	switch strings.ToLower(string(preceding[start:])) {
+	case "r", "br":
+		return true
+	default:
+		return false
+	}
+}
+
+func isIdentifierChar(char rune) bool {
+	return char == '_' || unicode.IsLetter(char) || unicode.IsDigit(char)
+}
+
+func isClosingBracket(char rune) bool {
+	return char == ')' || char == ']' || char == '}'
+}
+
+// celLiterals are the identifiers which are reserved by CEL for literals and
+// operators.
+var celLiterals = map[string]bool{"true": true, "false": true, "null": true, "in": true}
+
+// celMacros are the macros which bind their first argument as a variable.
+var celMacros = map[string]bool{"all": true, "exists": true, "exists_one": true, "map": true, "filter": true}
+
+// rootIdentifiers returns the names of the variables the expression refers
+// to, like "inputs" in "inputs.region". Fields, functions, literals and
+// variables bound by macros are not included.
+func rootIdentifiers(expression string) []string {
+	var (
+		lexer  expressionLexer
+		names  []string
+		macros = map[string]bool{}
+	)
+
+	for ix := 0; ix < len(expression); {
+		char, size := utf8.DecodeRuneInString(expression[ix:])
+
+		if lexer.quote != "" || !(char == '_' || unicode.IsLetter(char) || unicode.IsDigit(char)) {
+			lexer.advance(char, []byte(expression[:ix]))
+			ix += size
+			continue
+		}
+
+		end := ix
+		for end < len(expression) {
+			next, size := utf8.DecodeRuneInString(expression[end:])
+			if !isIdentifierChar(next) {
+				break
+			}
+			end += size
+		}
+
+		name := expression[ix:end]
+		preceding := strings.TrimRightFunc(expression[:ix], unicode.IsSpace)
+		following := strings.TrimLeftFunc(expression[end:], unicode.IsSpace)
+
+		switch {
+		case unicode.IsDigit(char), celLiterals[name]:
+		case strings.HasSuffix(preceding, "."), strings.HasSuffix(preceding, ".?"):
+		case strings.HasPrefix(following, "("), strings.HasPrefix(following, "'"), strings.HasPrefix(following, `"`):
+		case isMacroVariable(preceding):
+			macros[name] = true
+		default:
+			names = append(names, name)
+		}
+
+		for _, c := range name {
+			lexer.advance(c, []byte(expression[:ix]))
+		}
+		ix = end
+	}
+
+	return slices.DeleteFunc(names, func(name string) bool { return macros[name] })
+}
+
+// isMacroVariable returns whether an identifier preceded by the given part
+// of an expression is the variable bound by a macro, like x in list.all(x,
+// x > 0).
+func isMacroVariable(preceding string) bool {
+	rest, ok := strings.CutSuffix(preceding, "(")
+	if !ok {
+		return false
+	}
+
+	rest = strings.TrimRightFunc(rest, unicode.IsSpace)
+	start := strings.LastIndexFunc(rest, func(char rune) bool { return !isIdentifierChar(char) })
+
+	return start >= 0 && rest[start] == '.' && celMacros[rest[start+1:]]
+}
@@ -0,0 +1,112 @@
+package celplate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+// Includes configure the include directive, which renders a partial template
+// read from a file system in its place, e.g. ${{ include "labels.yaml" }}.
+type Includes struct {
+	// FS is the file system partials are read from, e.g. an embed.FS or
+	// os.DirFS. Paths of partials are always relative to its root.
+	FS fs.FS
+
+	// Indent makes every line of a partial but the first indented to the
+	// column of its include directive, so that it can be nested in YAML. The
+	// leading whitespace of the directive's line is repeated, e.g. with tabs,
+	// and the rest of the indentation is made of spaces.
+	Indent bool
+}
+
+// WithIncludes enables the include directive, reading partials as configured.
+func WithIncludes(includes Includes) Option {
+	return func(s *Scanner) {
+		s.includes = includes
+	}
+}
+
+// include parses the partial included by the tag, given the leading
+// whitespace of the line of the tag. The files being parsed are given in the
+// order they were included in, so that cycles can be detected. Problems with
+// the partial are reported as source errors, and no node is returned then.
+func (s *Scanner) include(ctx context.Context, tag *ExpressionNode, name, lineIndentation string, files []string, errs *source.Errors) (Node, error) {
+	if s.includes.FS == nil {
+		errs.Push(tagError(tag, "includes are not enabled"))
+		return nil, nil
+	}
+
+	name = path.Clean(name)
+	if !fs.ValidPath(name) {
+		errs.Push(tagError(tag, fmt.Sprintf("invalid include path %q", name)))
+		return nil, nil
+	}
+
+	if ix := slices.Index(files, name); ix >= 0 {
+		cycle := make([]string, 0, len(files)-ix+1)
+		for _, file := range append(files[ix:len(files):len(files)], name) {
+			cycle = append(cycle, strconv.Quote(file))
+		}
+
+		errs.Push(tagError(tag, fmt.Sprintf("include cycle detected: %s", strings.Join(cycle, " -> "))))
+		return nil, nil
+	}
+
+	data, err := fs.ReadFile(s.includes.FS, name)
+	if err != nil {
+		errs.Push(tagError(tag, fmt.Sprintf("failed to read included file: %v", err)))
+		return nil, nil
+	}
+
+	node := &IncludeNode{File: name, Start: tag.Start, End: tag.End}
+	if s.includes.Indent {
+		node.Indent = includeIndentation(lineIndentation, tag.Start.Column-1)
+	}
+
+	files = append(files[:len(files):len(files)], name)
+	addNode := func(n Node) error {
+		node.Nodes = appendNode(node.Nodes, n)
+		return nil
+	}
+
+	if err := s.parse(ctx, bytes.NewReader(data), files, errs, addNode); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// includeIndentation returns the indentation of a partial included at the
+// given column, zero-based, of a line with the given leading whitespace. The
+// whitespace is kept as it is, e.g. with tabs, and the rest of the column is
+// padded with spaces.
+func includeIndentation(lineIndentation string, column int) string {
+	if width := utf8.RuneCountInString(lineIndentation); width < column {
+		return lineIndentation + strings.Repeat(" ", column-width)
+	}
+
+	return lineIndentation
+}
+
+// indent prepends the indentation to every line of the text but the first,
+// leaving blank lines intact.
+func indent(text, indentation string) string {
+	lines := strings.SplitAfter(text, "\n")
+
+	for ix := 1; ix < len(lines); ix++ {
+		if strings.TrimSpace(lines[ix]) != "" {
+			lines[ix] = indentation + lines[ix]
+		}
+	}
+
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,166 @@
+package celplate_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestScanner_Transform_Include(t *testing.T) {
+	fsys := fstest.MapFS{
+		"labels.yaml":          {Data: []byte("team: ${{ team }}\nowner: ${{ owner }}\n")},
+		"partials/stack.yaml":  {Data: []byte("name: ${{ name }}\n${{ include \"labels.yaml\" }}")},
+		"partials/region.yaml": {Data: []byte("- ${{ item }}")},
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		indent bool
+		want   string
+	}{
+		{
+			name:  "partial",
+			input: "a: 1\n${{ include \"labels.yaml\" }}b: 2",
+			want:  "a: 1\nteam: platform\nowner: alice\nb: 2",
+		},
+		{
+			name:  "nested partials",
+			input: "${{ include \"partials/stack.yaml\" }}",
+			want:  "name: app\nteam: platform\nowner: alice\n",
+		},
+		{
+			name:  "partial inside of a loop",
+			input: "${{- for item in list }}\n${{ include `partials/region.yaml` }}\n${{- end }}",
+			want:  "\n- a\n- b",
+		},
+		{
+			name:   "re-indented partial",
+			input:  "stack:\n  labels:\n    ${{ include \"./labels.yaml\" }}",
+			indent: true,
+			want:   "stack:\n  labels:\n    team: platform\n    owner: alice\n",
+		},
+		{
+			name:   "partial re-indented with tabs",
+			input:  "stack:\n\t${{ include \"labels.yaml\" }}",
+			indent: true,
+			want:   "stack:\n\tteam: platform\n\towner: alice\n",
+		},
+		{
+			name:   "partial re-indented after other text",
+			input:  "\t- ${{ include \"labels.yaml\" }}",
+			indent: true,
+			want:   "\t- team: platform\n\t  owner: alice\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := celplate.NewScanner(varsEvaluator{
+				"team":  "platform",
+				"owner": "alice",
+				"name":  "app",
+				"list":  []string{"a", "b"},
+			}, celplate.WithIncludes(celplate.Includes{FS: fsys, Indent: tt.indent}))
+
+			output, err := sut.Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestScanner_Transform_IncludeErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.yaml":       {Data: []byte("${{ include \"b.yaml\" }}")},
+		"b.yaml":       {Data: []byte("b\n  ${{ include \"a.yaml\" }}")},
+		"invalid.yaml": {Data: []byte("ok\n${{ missing }} ${{ if }}${{ end }}")},
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		opts  []celplate.Option
+		want  string
+	}{
+		{
+			name:  "includes are not enabled",
+			input: "${{ include \"a.yaml\" }}",
+			want:  "line 1, column 1 to line 1, column 24: includes are not enabled",
+		},
+		{
+			name:  "missing file name",
+			input: "${{ include }}",
+			opts:  []celplate.Option{celplate.WithIncludes(celplate.Includes{FS: fsys})},
+			want:  `line 1, column 1 to line 1, column 15: invalid "include" directive, expected a quoted file name`,
+		},
+		{
+			name:  "invalid path",
+			input: "${{ include \"../a.yaml\" }}",
+			opts:  []celplate.Option{celplate.WithIncludes(celplate.Includes{FS: fsys})},
+			want:  `line 1, column 1 to line 1, column 27: invalid include path "../a.yaml"`,
+		},
+		{
+			name:  "missing file",
+			input: "${{ include \"c.yaml\" }}",
+			opts:  []celplate.Option{celplate.WithIncludes(celplate.Includes{FS: fsys})},
+			want:  "line 1, column 1 to line 1, column 24: failed to read included file: open c.yaml: file does not exist",
+		},
+		{
+			name:  "include cycle",
+			input: "${{ include \"a.yaml\" }}",
+			opts:  []celplate.Option{celplate.WithIncludes(celplate.Includes{FS: fsys})},
+			want:  `b.yaml: line 2, column 3 to line 2, column 26: include cycle detected: "a.yaml" -> "b.yaml" -> "a.yaml"`,
+		},
+		{
+			name:  "errors inside of a partial",
+			input: "${{ include \"invalid.yaml\" }}",
+			opts:  []celplate.Option{celplate.WithIncludes(celplate.Includes{FS: fsys})},
+			want: `invalid.yaml: line 2, column 16 to line 2, column 25: missing condition in "if" directive; ` +
+				`invalid.yaml: line 2, column 1 to line 2, column 15: unknown variable "missing"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := celplate.NewScanner(varsEvaluator{}, tt.opts...)
+
+			_, err := sut.Transform([]byte(tt.input))
+
+			assert.EqualError(t, err, tt.want)
+		})
+	}
+}
+
+func TestParse_Include(t *testing.T) {
+	fsys := fstest.MapFS{"labels.yaml": {Data: []byte("${{ team }}")}}
+
+	template, err := celplate.Parse([]byte("  ${{ include \"labels.yaml\" }}"), celplate.WithIncludes(celplate.Includes{FS: fsys, Indent: true}))
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Node{
+		&celplate.TextNode{
+			Text:  "  ",
+			Start: source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+			End:   source.Location{Index: 2, Line: 1, Column: 3, Offset: 2, UTF16Column: 3},
+		},
+		&celplate.IncludeNode{
+			File: "labels.yaml",
+			Nodes: []celplate.Node{&celplate.ExpressionNode{
+				Expression:      " team ",
+				Start:           source.Location{File: "labels.yaml", Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+				End:             source.Location{File: "labels.yaml", Index: 11, Line: 1, Column: 12, Offset: 11, UTF16Column: 12},
+				ExpressionStart: source.Location{File: "labels.yaml", Index: 3, Line: 1, Column: 4, Offset: 3, UTF16Column: 4},
+			}},
+			Indent: "  ",
+			Start:  source.Location{Index: 2, Line: 1, Column: 3, Offset: 2, UTF16Column: 3},
+			End:    source.Location{Index: 30, Line: 1, Column: 31, Offset: 30, UTF16Column: 31},
+		},
+	}, template.Nodes())
+}
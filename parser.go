@@ -0,0 +1,736 @@
+package celplate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+// parser turns the source of a template into nodes, passing each of them to
+// emit as soon as it's complete.
+type parser struct {
+	delimiters Delimiters
+	comments   Comments
+	emit       func(Node) error
+
+	expression      *bytes.Buffer
+	expressionStart source.Location
+	text            *bytes.Buffer
+	textStart       source.Location
+	textEnd         source.Location
+	space           *bytes.Buffer
+	spaceStart      source.Location
+	spaceEnd        source.Location
+
+	// escapes are the byte offsets in the text of the opening delimiters
+	// written for escape sequences.
+	escapes []int
+
+	// trimSpace is set after a closing delimiter with a trim marker, until
+	// the following whitespace is skipped.
+	trimSpace bool
+
+	// blockComment is the block comment the parser is inside of, which
+	// started at blockCommentStart.
+	blockComment      BlockComment
+	blockCommentStart source.Location
+
+	// quote is the quote of the string the parser is inside of, if any, and
+	// quoteEscaped is set when the following character is escaped.
+	quote        rune
+	quoteEscaped bool
+
+	// scalarIndentation is the indentation of the line opening the current
+	// YAML block scalar, or -1 outside of block scalars.
+	scalarIndentation int
+
+	// lineIndentation is the leading whitespace of the current line, and
+	// expressionIndentation is the one of the line the last expression
+	// started on.
+	lineIndentation       string
+	expressionIndentation string
+
+	// textStops are the characters which may start a delimiter or a comment.
+	// Text up to any of them is written out at once.
+	textStops string
+
+	errs     *source.Errors
+	lexer    expressionLexer
+	pending  []pendingChar
+	state    scannerState
+	location *source.Location
+}
+
+type scannerState int
+
+const byteOrderMark = "\ufeff"
+
+// pendingChar is a character held back while the parser cannot yet tell
+// whether it is a part of a delimiter.
+type pendingChar struct {
+	char rune
+
+	// raw is the character as it appears in the source. It only differs from
+	// char for bytes which are not valid UTF-8, which are kept intact.
+	raw string
+
+	location source.Location
+}
+
+const (
+	// ssDefault is the state outside of an expression block.
+	ssDefault scannerState = iota
+
+	// ssOpening is the state where pending characters are a prefix of the
+	// opening delimiter or of the escape sequence.
+	ssOpening
+
+	// ssExpression is the state inside of an expression block.
+	ssExpression
+
+	// ssClosing is the state where pending characters are a prefix of the
+	// closing delimiter.
+	ssClosing
+
+	// ssBlockComment is the state inside of a block comment.
+	ssBlockComment
+)
+
+func newParser(delimiters Delimiters, comments Comments, errs *source.Errors, emit func(Node) error) *parser {
+	return &parser{
+		delimiters:        delimiters,
+		comments:          comments,
+		emit:              emit,
+		expression:        bytes.NewBuffer(nil),
+		text:              bytes.NewBuffer(nil),
+		space:             bytes.NewBuffer(nil),
+		errs:              errs,
+		state:             ssDefault,
+		location:          source.Start(),
+		scalarIndentation: -1,
+		textStops:         textStops(delimiters, comments),
+	}
+}
+
+// textStops returns the first characters of the opening delimiter, the escape
+// sequence and the comments.
+func textStops(delimiters Delimiters, comments Comments) string {
+	var sb strings.Builder
+
+	for _, sequence := range append([]string{delimiters.Open, delimiters.Escape}, comments.Line...) {
+		if char, _ := utf8.DecodeRuneInString(sequence); sequence != "" && !strings.ContainsRune(sb.String(), char) {
+			sb.WriteRune(char)
+		}
+	}
+
+	for _, block := range comments.Block {
+		if char, _ := utf8.DecodeRuneInString(block.Open); !strings.ContainsRune(sb.String(), char) {
+			sb.WriteRune(char)
+		}
+	}
+
+	if comments.Quotes != "" {
+		sb.WriteString(comments.Quotes + `\`)
+	}
+
+	return sb.String()
+}
+
+// parse consumes the whole input from the reader. Errors in the source are
+// gathered, while reading, context and emitting errors are returned.
+func (p *parser) parse(ctx context.Context, r io.Reader) error {
+	if err := p.delimiters.validate(); err != nil {
+		return err
+	}
+
+	if err := p.comments.validate(); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(r)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return readErr
+		}
+
+		if err := p.parseLine(line); err != nil {
+			return err
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	return p.finish()
+}
+
+// parseLine parses a single line of input, including its line break, if any.
+func (p *parser) parseLine(line []byte) error {
+	text := string(line)
+
+	// A byte order mark is written out as is, but it's not a part of the
+	// first line, nor does it take a column.
+	if p.location.Offset == 0 && strings.HasPrefix(text, byteOrderMark) {
+		start := *p.location
+		p.location.Offset += len(byteOrderMark)
+		p.writeText(byteOrderMark, start, *p.location)
+		text = text[len(byteOrderMark):]
+	}
+
+	commentsAllowed := p.startLine(text)
+	p.lineIndentation = text[:len(text)-len(strings.TrimLeftFunc(text, unicode.IsSpace))]
+
+	// Strings do not span lines.
+	p.quote, p.quoteEscaped = 0, false
+
+	// content is set once anything but whitespace is seen on the line, so
+	// that the text preceding comments is not scanned again and again.
+	content := false
+
+	// commentLine is set when the whole line is a line comment.
+	commentLine := false
+
+	for ix := 0; ix < len(text); {
+		// Comments are only recognised outside of expressions.
+		if p.state == ssBlockComment {
+			ix += p.consumeBlockComment(text[ix:])
+			content = true
+			continue
+		}
+
+		if p.state == ssDefault && commentsAllowed && p.quote == 0 {
+			if size, lineComment := p.consumeComment(text, ix, content); size > 0 {
+				commentLine = lineComment && !content
+				ix += size
+				content = true
+				continue
+			}
+		}
+
+		// Text which cannot start a delimiter nor a comment is written out
+		// as a whole.
+		if p.state == ssDefault {
+			if size := p.consumePlainText(text[ix:]); size > 0 {
+				if !content && strings.TrimLeftFunc(text[ix:ix+size], unicode.IsSpace) != "" {
+					content = true
+				}
+				p.quoteEscaped = false
+				ix += size
+				continue
+			}
+		}
+
+		char, size := utf8.DecodeRuneInString(text[ix:])
+		if !unicode.IsSpace(char) {
+			content = true
+		}
+
+		// A carriage return followed by a line feed is a single line break.
+		if strings.HasPrefix(text[ix:], "\r\n") {
+			char, size = '\n', 2
+		}
+
+		// Characters held back as a possible delimiter are text too, unless
+		// the delimiter is complete.
+		if p.state == ssDefault || p.state == ssOpening {
+			p.trackQuote(char)
+		}
+
+		raw := text[ix : ix+size]
+		ix += size
+
+		err := p.consumeWithError(char, raw)
+
+		var sourceErr *source.Error
+		if err != nil && !errors.As(err, &sourceErr) {
+			return err
+		}
+
+		p.errs.Push(err)
+	}
+
+	if p.comments.YAMLBlockScalars && p.state == ssDefault && p.scalarIndentation < 0 && !commentLine && opensYAMLBlockScalar(text) {
+		p.scalarIndentation = indentation(text)
+	}
+
+	// Text is emitted line by line, so that it does not pile up in memory.
+	if p.state == ssDefault || p.state == ssBlockComment {
+		return p.flushText(false)
+	}
+
+	return nil
+}
+
+// startLine returns whether comments can be recognised in the line, which is
+// not the case inside of YAML block scalars.
+func (p *parser) startLine(line string) bool {
+	if p.scalarIndentation < 0 || p.state != ssDefault {
+		return true
+	}
+
+	if indent := indentation(line); indent >= 0 && indent <= p.scalarIndentation {
+		p.scalarIndentation = -1
+		return true
+	}
+
+	return false
+}
+
+// consumeComment consumes a comment starting at the given byte index of the
+// line, if any, and returns the number of bytes consumed and whether it's
+// a line comment. The content flag tells whether anything but whitespace
+// precedes the index on the line.
+func (p *parser) consumeComment(line string, index int, content bool) (int, bool) {
+	if block, ok := p.comments.blockCommentAt(line, index); ok {
+		p.blockComment = block
+		p.blockCommentStart = *p.location
+		p.state = ssBlockComment
+		p.writeVerbatim(block.Open)
+
+		return len(block.Open) + p.consumeBlockComment(line[index+len(block.Open):]), false
+	}
+
+	if p.comments.lineCommentAt(line, index, content) {
+		p.writeVerbatim(line[index:])
+		return len(line) - index, true
+	}
+
+	return 0, false
+}
+
+// consumeBlockComment consumes the given part of a line inside of a block
+// comment, up to the end of the comment, and returns the number of bytes
+// consumed.
+func (p *parser) consumeBlockComment(text string) int {
+	end := strings.Index(text, p.blockComment.Close)
+	if end < 0 {
+		p.writeVerbatim(text)
+		return len(text)
+	}
+
+	end += len(p.blockComment.Close)
+	p.writeVerbatim(text[:end])
+	p.state = ssDefault
+
+	return end
+}
+
+// trackQuote updates the string the parser is inside of with the given
+// character of text.
+func (p *parser) trackQuote(char rune) {
+	switch {
+	case p.quote == 0:
+		if strings.ContainsRune(p.comments.Quotes, char) {
+			p.quote = char
+		}
+	case p.quoteEscaped:
+		p.quoteEscaped = false
+	case char == '\\':
+		p.quoteEscaped = true
+	case char == p.quote:
+		p.quote = 0
+	}
+}
+
+// consumePlainText writes out the text up to the first character which may
+// start a delimiter or a comment, and returns the number of bytes consumed.
+func (p *parser) consumePlainText(text string) int {
+	size := strings.IndexAny(text, p.textStops)
+	if size < 0 {
+		size = len(text)
+	}
+
+	if size > 0 {
+		p.writeVerbatim(text[:size])
+	}
+
+	return size
+}
+
+// writeChar writes the character as it appears in the source.
+func (p *parser) writeChar(c pendingChar) {
+	p.writeText(c.raw, c.location, advancedBy(c.location, c.raw))
+}
+
+// writeVerbatim writes the text at the current location as is.
+func (p *parser) writeVerbatim(text string) {
+	start := *p.location
+	*p.location = advancedBy(start, text)
+
+	p.writeText(text, start, *p.location)
+}
+
+// finish handles the end of input.
+func (p *parser) finish() error {
+	p.flushPending()
+
+	if p.state == ssBlockComment {
+		p.errs.Push(&source.Error{
+			Location: p.blockCommentStart,
+			Message:  fmt.Sprintf("unclosed block comment, expected %q", p.blockComment.Close),
+		})
+		p.state = ssDefault
+	}
+
+	if p.state != ssDefault {
+		p.errs.Push(&source.Error{
+			Location: *p.location,
+			Message:  "unexpected end of input",
+		})
+	}
+
+	return p.flushText(true)
+}
+
+func (p *parser) consumeWithError(char rune, raw string) error {
+	defer func() { p.location.AdvanceString(raw) }()
+
+	err := p.consume(pendingChar{char, raw, *p.location})
+	if err != nil {
+		p.resetPending(ssDefault)
+		p.resetExpression()
+	}
+
+	return err
+}
+
+func (p *parser) consume(c pendingChar) error {
+	switch p.state {
+	case ssDefault, ssOpening:
+		return p.onText(c)
+	case ssExpression, ssClosing:
+		return p.onExpression(c)
+	}
+
+	return fmt.Errorf("impossible to handle state %q", p.state)
+}
+
+func (p *parser) onText(c pendingChar) (err error) {
+	p.pending = append(p.pending, c)
+	sequence := p.pendingString()
+	escaped := p.delimiters.escapedOpen()
+
+	switch {
+	case escaped != "" && sequence == escaped:
+		p.escapes = append(p.escapes, p.text.Len()+p.space.Len())
+		p.writeText(p.delimiters.Open, p.pending[0].location, advancedBy(c.location, c.raw))
+		p.resetPending(ssDefault)
+	case sequence == p.delimiters.Open && !strings.HasPrefix(escaped, sequence):
+		p.openExpression()
+	case strings.HasPrefix(p.delimiters.Open, sequence) || strings.HasPrefix(escaped, sequence):
+		p.state = ssOpening
+	default:
+		return p.rewindText()
+	}
+
+	return
+}
+
+// rewindText handles pending characters which turned out not to form
+// a delimiter. The first of them is written out, and the rest is consumed
+// again since it may still start a delimiter.
+func (p *parser) rewindText() (err error) {
+	pending := p.pending
+	last := len(pending) - 1
+
+	// The opening delimiter was waiting to become an escape sequence, but it
+	// did not, so it opens an expression after all.
+	if pendingString(pending[:last]) == p.delimiters.Open {
+		p.pending = pending[:last]
+		p.openExpression()
+		return p.onExpression(pending[last])
+	}
+
+	p.resetPending(ssDefault)
+	p.writeChar(pending[0])
+
+	for _, c := range pending[1:] {
+		if err = p.onText(c); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// openExpression starts an expression at the pending opening delimiter.
+func (p *parser) openExpression() {
+	p.expressionStart = p.pending[0].location
+	p.expressionIndentation = p.lineIndentation
+	p.resetPending(ssExpression)
+}
+
+func (p *parser) onExpression(c pendingChar) (err error) {
+	if p.state == ssExpression && p.lexer.captures(c.char) {
+		p.appendExpression(c)
+		return
+	}
+
+	p.pending = append(p.pending, c)
+	sequence := p.pendingString()
+
+	switch {
+	case sequence == p.delimiters.Close:
+		return p.closeExpression(advancedBy(c.location, c.raw))
+	case strings.HasPrefix(p.delimiters.Close, sequence):
+		p.state = ssClosing
+		return
+	}
+
+	// The pending characters did not form the closing delimiter, so the first
+	// of them is a part of the expression.
+	pending := p.pending
+	p.resetPending(ssExpression)
+
+	// An unbalanced closing bracket cannot be a part of a valid expression, so
+	// it must have been a mistyped closing delimiter.
+	if len(pending) > 1 && isClosingBracket(pending[0].char) && p.lexer.atTopLevel() {
+		return &source.Error{
+			Location: c.location,
+			Message:  fmt.Sprintf("unexpected character %q, expected %q", c.char, []rune(p.delimiters.Close)[len(pending)-1]),
+		}
+	}
+
+	p.appendExpression(pending[0])
+
+	for _, c := range pending[1:] {
+		if err = p.onExpression(c); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (p *parser) appendExpression(c pendingChar) {
+	p.lexer.advance(c.char, p.expression.Bytes())
+	p.expression.WriteString(c.raw)
+}
+
+// closeExpression emits the text preceding the current expression, and then
+// the expression itself, which ends right before the given location.
+func (p *parser) closeExpression(end source.Location) error {
+	expression, trimBefore, trimAfter := cutTrimMarkers(p.expression.String())
+
+	expressionStart := advancedBy(p.expressionStart, p.delimiters.Open)
+	if trimBefore {
+		expressionStart = advancedBy(expressionStart, "-")
+	}
+
+	node := &ExpressionNode{
+		Expression:      expression,
+		Start:           p.expressionStart,
+		End:             end,
+		ExpressionStart: expressionStart,
+	}
+
+	p.resetPending(ssDefault)
+	p.resetExpression()
+
+	if trimBefore {
+		p.space.Reset()
+	}
+
+	if err := p.flushText(true); err != nil {
+		return err
+	}
+
+	p.trimSpace = trimAfter
+
+	return p.emit(node)
+}
+
+// writeText appends text spanning from start to end in the source. Trailing
+// whitespace is held back separately, so that a following trim marker can
+// still remove it.
+//
+// Whitespace in the text is expected to match the source character by
+// character, which only escape sequences do not do.
+func (p *parser) writeText(text string, start, end source.Location) {
+	if p.trimSpace {
+		trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+		start = advancedBy(start, text[:len(text)-len(trimmed)])
+		text = trimmed
+
+		if text == "" {
+			return
+		}
+
+		p.trimSpace = false
+	}
+
+	content := strings.TrimRightFunc(text, unicode.IsSpace)
+	if content == "" {
+		if p.space.Len() == 0 {
+			p.spaceStart = start
+		}
+
+		p.space.WriteString(text)
+		p.spaceEnd = end
+		return
+	}
+
+	// The whitespace held back so far is followed by other text, so it stays.
+	p.moveSpace()
+
+	if p.text.Len() == 0 {
+		p.textStart = start
+	}
+
+	p.text.WriteString(content)
+	p.textEnd = end
+
+	if len(content) < len(text) {
+		p.textEnd = advancedBy(start, content)
+		p.spaceStart = p.textEnd
+		p.space.WriteString(text[len(content):])
+		p.spaceEnd = end
+	}
+}
+
+// moveSpace moves the whitespace held back into the text.
+func (p *parser) moveSpace() {
+	if p.space.Len() == 0 {
+		return
+	}
+
+	if p.text.Len() == 0 {
+		p.textStart = p.spaceStart
+	}
+
+	_, _ = p.space.WriteTo(p.text)
+	p.textEnd = p.spaceEnd
+}
+
+// flushText emits the text written so far, if any. The trailing whitespace
+// held back is only emitted along with it if withSpace is set.
+func (p *parser) flushText(withSpace bool) error {
+	if withSpace {
+		p.moveSpace()
+	}
+
+	if p.text.Len() == 0 {
+		return nil
+	}
+
+	node := &TextNode{
+		Text:   p.text.String(),
+		Source: p.textSource(),
+		Start:  p.textStart,
+		End:    p.textEnd,
+	}
+	p.text.Reset()
+	p.escapes = nil
+
+	return p.emit(node)
+}
+
+// textSource returns the text written so far as it appears in the source, if
+// it differs because of escape sequences, or an empty string otherwise.
+func (p *parser) textSource() string {
+	if len(p.escapes) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	text := p.text.String()
+	last := 0
+
+	for _, offset := range p.escapes {
+		sb.WriteString(text[last:offset])
+		sb.WriteString(p.delimiters.Escape)
+		last = offset
+	}
+
+	sb.WriteString(text[last:])
+	return sb.String()
+}
+
+// flushPending handles characters held back at the end of input.
+func (p *parser) flushPending() {
+	if p.state != ssOpening {
+		return
+	}
+
+	pending := p.pending
+
+	if pendingString(pending) == p.delimiters.Open {
+		p.expressionStart = pending[0].location
+		p.resetPending(ssExpression)
+		return
+	}
+
+	p.resetPending(ssDefault)
+	for _, c := range pending {
+		p.writeChar(c)
+	}
+}
+
+func (p *parser) resetPending(state scannerState) {
+	p.pending = nil
+	p.state = state
+}
+
+func (p *parser) resetExpression() {
+	p.expression.Reset()
+	p.lexer = expressionLexer{}
+}
+
+func (p *parser) pendingString() string {
+	return pendingString(p.pending)
+}
+
+func pendingString(pending []pendingChar) string {
+	var sb strings.Builder
+	for _, c := range pending {
+		sb.WriteString(c.raw)
+	}
+	return sb.String()
+}
+
+// cutTrimMarkers removes whitespace trim markers from the expression. A trim
+// marker is a dash directly after the opening delimiter or directly before the
+// closing delimiter, separated from the expression by whitespace. This way
+// expressions like ${{-1}} are left intact.
+func cutTrimMarkers(expression string) (_ string, trimBefore, trimAfter bool) {
+	if rest, ok := strings.CutPrefix(expression, "-"); ok && startsWithSpace(rest) {
+		expression, trimBefore = rest, true
+	}
+
+	if rest, ok := strings.CutSuffix(expression, "-"); ok && endsWithSpace(rest) {
+		expression, trimAfter = rest, true
+	}
+
+	return expression, trimBefore, trimAfter
+}
+
+func startsWithSpace(s string) bool {
+	char, _ := utf8.DecodeRuneInString(s)
+	return s != "" && unicode.IsSpace(char)
+}
+
+func endsWithSpace(s string) bool {
+	char, _ := utf8.DecodeLastRuneInString(s)
+	return s != "" && unicode.IsSpace(char)
+}
+
+// advancedBy returns the location following the given text.
+func advancedBy(location source.Location, text string) source.Location {
+	location.AdvanceString(text)
+	return location
+}
@@ -0,0 +1,299 @@
+package celplate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+// TransformPartial transforms the given template like Transform, except for
+// the expressions referring to variables without values. They are written
+// back instead, after evaluating their parts which can be evaluated, so that
+// the output is a template which can be transformed once the values are
+// known, e.g. with another evaluator.
+//
+// The same goes for block directives. Conditional blocks are rendered up to
+// the first condition which cannot be evaluated, and the remaining branches
+// are written back. Loops over collections which cannot be evaluated are
+// written back, with their loop variables left without values, and so are
+// set directives whose values cannot be evaluated. Inside of blocks which are
+// rendered, like loops over known collections, such set directives are
+// wrapped in a block with a true condition, so that they stay scoped to them.
+//
+// The evaluator must be a PartialEvaluator.
+func (s *Scanner) TransformPartial(input []byte) ([]byte, error) {
+	if _, ok := s.evaluator.(PartialEvaluator); !ok {
+		return nil, errors.New("the evaluator does not support partial evaluation")
+	}
+
+	var output bytes.Buffer
+
+	errs := &source.Errors{}
+	executor := newExecutor(context.Background(), s.evaluator, &output, errs)
+	executor.partial, executor.delimiters = true, s.delimiters
+	executor.limit = s.outputLimit()
+
+	if err := s.parse(context.Background(), bytes.NewReader(input), []string{s.fileName}, errs, executor.execute); err != nil {
+		return nil, err
+	}
+
+	if err := executor.flush(); err != nil {
+		return nil, err
+	}
+
+	if err := errs.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
+}
+
+// residual returns the residual of the expression starting at the given
+// location, and true as the second value if the expression refers to
+// variables without values. The last value is false if the expression could
+// not be evaluated.
+func (e *executor) residual(expression string, start source.Location, rng source.Range) (residual string, unknown, ok bool) {
+	evaluator, ok := e.evaluator.(PartialEvaluator)
+	if !ok {
+		e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: "the evaluator does not support partial evaluation"})
+		return "", false, false
+	}
+
+	residual, unknown, err := evaluator.Residual(expression)
+	if err != nil {
+		e.pushError(err, start, rng)
+		return "", false, false
+	}
+
+	return residual, unknown, true
+}
+
+// withUnknowns returns an executor whose evaluator has no values for the given
+// variables.
+func (e *executor) withUnknowns(names []string, rng source.Range) (*executor, bool) {
+	evaluator, err := e.evaluator.(PartialEvaluator).WithUnknowns(names...)
+	if err != nil {
+		e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: err.Error()})
+		return nil, false
+	}
+
+	unknown := *e
+	unknown.evaluator = evaluator
+
+	return &unknown, true
+}
+
+// writeTag writes back an expression block with the given contents, for the
+// given range of the template.
+func (e *executor) writeTag(contents string, rng source.Range) error {
+	return e.write(e.delimiters.Open+" "+contents+" "+e.delimiters.Close, Segment{Range: rng})
+}
+
+// escape escapes the opening delimiters in the output of an expression when
+// the template is rendered partially, so that they are not evaluated later.
+func (e *executor) escape(output string) string {
+	if !e.partial || e.delimiters.Escape == "" {
+		return output
+	}
+
+	return strings.ReplaceAll(output, e.delimiters.Open, e.delimiters.Escape+e.delimiters.Open)
+}
+
+// writeExpression writes back the residual of the expression, and returns
+// whether it did, or whether it could not be evaluated.
+func (e *executor) writeExpression(node *ExpressionNode) (bool, error) {
+	rng := source.Range{Start: node.Start, End: node.End}
+
+	residual, unknown, ok := e.residual(node.Expression, node.ExpressionStart, rng)
+	if !ok || !unknown {
+		return !ok, nil
+	}
+
+	return true, e.writeTag(residual, rng)
+}
+
+// executePartialIf renders the branches of the node until the first one whose
+// condition refers to variables without values. That branch and the following
+// ones are written back as a conditional block.
+func (e *executor) executePartialIf(node *IfNode) error {
+	for ix, branch := range node.Branches {
+		residual, unknown, ok := e.residual(branch.Condition, branch.ConditionStart, argumentRange(branch.ConditionStart, branch.Condition))
+		if !ok {
+			return nil
+		}
+
+		if unknown {
+			return e.writeIf(node, ix, residual)
+		}
+
+		holds, ok := e.evaluateCondition(branch)
+		if !ok {
+			return nil
+		}
+
+		if holds {
+			return e.executeUnwrapped(branch.Nodes, source.Range{Start: node.Start, End: node.End})
+		}
+	}
+
+	return e.executeUnwrapped(node.Else, source.Range{Start: node.Start, End: node.End})
+}
+
+// writeIf writes back the branches of the node starting at the given one,
+// whose condition has the given residual. Following branches whose conditions
+// don't hold are left out, and a branch whose condition holds becomes the else
+// branch.
+func (e *executor) writeIf(node *IfNode, first int, residual string) error {
+	rng := source.Range{Start: node.Start, End: node.End}
+
+	if err := e.writeBranch(keywordIf+" "+residual, branchRange(node.Branches[first]), node.Branches[first].Nodes); err != nil {
+		return err
+	}
+
+	for _, branch := range node.Branches[first+1:] {
+		residual, unknown, ok := e.residual(branch.Condition, branch.ConditionStart, argumentRange(branch.ConditionStart, branch.Condition))
+		if !ok {
+			return nil
+		}
+
+		if unknown {
+			if err := e.writeBranch(keywordElseIf+" "+residual, branchRange(branch), branch.Nodes); err != nil {
+				return err
+			}
+			continue
+		}
+
+		holds, ok := e.evaluateCondition(branch)
+		if !ok {
+			return nil
+		}
+
+		if holds {
+			if err := e.writeBranch(keywordElse, branchRange(branch), branch.Nodes); err != nil {
+				return err
+			}
+			return e.writeTag(keywordEnd, rng)
+		}
+	}
+
+	if node.Else != nil {
+		if err := e.writeBranch(keywordElse, rng, node.Else); err != nil {
+			return err
+		}
+	}
+
+	return e.writeTag(keywordEnd, rng)
+}
+
+// branchRange returns the range of the directive opening the branch.
+func branchRange(branch *IfBranch) source.Range {
+	return source.Range{Start: branch.Start, End: branch.End}
+}
+
+// writeBranch writes back the directive opening a branch, for the given range
+// of the template, followed by its nodes.
+func (e *executor) writeBranch(directive string, rng source.Range, nodes []Node) error {
+	if err := e.writeTag(directive, rng); err != nil {
+		return err
+	}
+
+	// The branch is a block of its own in the output.
+	branch := *e
+	branch.unwrapped = nil
+
+	return branch.executeAll(nodes)
+}
+
+// unwrappedBlock is a block of the template rendered partially without its
+// directives, like an iteration of a loop or a branch whose condition holds.
+type unwrappedBlock struct {
+	// opened is set once a block keeping the variables of set directives
+	// written back inside of it scoped is opened in the output.
+	opened bool
+}
+
+// executeUnwrapped executes the nodes of a block, closing the given range,
+// whose directives are not written back when the template is rendered
+// partially. Set directives written back inside of it are wrapped in a block
+// of their own, so that their variables stay scoped to it, e.g. to a single
+// iteration of a loop.
+func (e *executor) executeUnwrapped(nodes []Node, rng source.Range) error {
+	if !e.partial {
+		return e.executeAll(nodes)
+	}
+
+	block := *e
+	block.unwrapped = &unwrappedBlock{}
+
+	if err := block.executeAll(nodes); err != nil {
+		return err
+	}
+
+	if !block.unwrapped.opened {
+		return nil
+	}
+
+	return e.writeTag(keywordEnd, rng)
+}
+
+// writeFor writes back the loop if its collection refers to variables without
+// values, and returns whether it did, or whether the collection could not be
+// evaluated.
+func (e *executor) writeFor(node *ForNode) (bool, error) {
+	rng := argumentRange(node.CollectionStart, node.Collection)
+
+	residual, unknown, ok := e.residual(node.Collection, node.CollectionStart, rng)
+	if !ok || !unknown {
+		return !ok, nil
+	}
+
+	variables := []string{node.Value}
+	if node.Key != "" {
+		variables = []string{node.Key, node.Value}
+	}
+
+	body, ok := e.withUnknowns(variables, rng)
+	if !ok {
+		return true, nil
+	}
+
+	tag := source.Range{Start: node.Start, End: node.End}
+
+	if err := body.writeBranch(keywordFor+" "+strings.Join(variables, ", ")+" in "+residual, tag, node.Nodes); err != nil {
+		return true, err
+	}
+
+	return true, e.writeTag(keywordEnd, tag)
+}
+
+// writeSet writes back the set directive if its value refers to variables
+// without values, and returns whether it did, or whether the value could not
+// be evaluated. The variable is then left without a value.
+func (e *executor) writeSet(node *SetNode) (bool, error) {
+	rng := argumentRange(node.ValueStart, node.Value)
+
+	residual, unknown, ok := e.residual(node.Value, node.ValueStart, rng)
+	if !ok || !unknown {
+		return !ok, nil
+	}
+
+	if scope, ok := e.withUnknowns([]string{node.Name}, rng); ok {
+		e.evaluator = scope.evaluator
+	}
+
+	tag := source.Range{Start: node.Start, End: node.End}
+
+	// Blocks which are not written back do not scope the variable anymore,
+	// so a block which always renders is opened in their place.
+	if e.unwrapped != nil && !e.unwrapped.opened {
+		e.unwrapped.opened = true
+		if err := e.writeTag(keywordIf+" true", tag); err != nil {
+			return true, err
+		}
+	}
+
+	return true, e.writeTag(keywordSet+" "+node.Name+" = "+residual, tag)
+}
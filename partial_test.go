@@ -0,0 +1,121 @@
+package celplate_test
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+)
+
+// partialEvaluator is a varsEvaluator whose variables with nil values have
+// no values yet.
+type partialEvaluator struct {
+	varsEvaluator
+}
+
+func (p partialEvaluator) Residual(expression string) (string, bool, error) {
+	name := strings.TrimSpace(expression)
+	if value, ok := p.varsEvaluator[name]; ok && value == nil {
+		return name, true, nil
+	}
+
+	return "", false, nil
+}
+
+func (p partialEvaluator) WithUnknowns(names ...string) (celplate.Evaluator, error) {
+	vars := maps.Clone(p.varsEvaluator)
+	for _, name := range names {
+		vars[name] = nil
+	}
+
+	return partialEvaluator{vars}, nil
+}
+
+func (p partialEvaluator) WithVariables(vars map[string]any) (celplate.Evaluator, error) {
+	merged := maps.Clone(p.varsEvaluator)
+	maps.Copy(merged, vars)
+
+	return partialEvaluator{merged}, nil
+}
+
+func TestScanner_TransformPartial(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "expressions",
+			input: "${{ known }} ${{ unknown }} $${{ escaped }} ${{ delimiter }}",
+			want:  "a ${{ unknown }} $${{ escaped }} $${{ x }}",
+		},
+		{
+			name:  "known condition",
+			input: "${{ if no }}a${{ else if unknown }}b${{ else }}c${{ end }}",
+			want:  "${{ if unknown }}b${{ else }}c${{ end }}",
+		},
+		{
+			name:  "known later condition",
+			input: "${{ if unknown }}a${{ else if no }}b${{ else if yes }}c${{ else }}d${{ end }}",
+			want:  "${{ if unknown }}a${{ else }}c${{ end }}",
+		},
+		{
+			name:  "holding condition",
+			input: "${{ if yes }}a${{ else if unknown }}b${{ end }}",
+			want:  "a",
+		},
+		{
+			name:  "known loop",
+			input: "${{ for item in list }}${{ item }}${{ unknown }}${{ end }}",
+			want:  "x${{ unknown }}y${{ unknown }}",
+		},
+		{
+			name:  "unknown loop",
+			input: "${{ for ix, list in unknown }}${{ ix }}${{ list }}${{ known }}${{ end }}${{ list }}",
+			want:  "${{ for ix, list in unknown }}${{ ix }}${{ list }}a${{ end }}[x y]",
+		},
+		{
+			name:  "set directives",
+			input: "${{ set a = known }}${{ set b = unknown }}${{ a }}${{ b }}",
+			want:  "${{ set b = unknown }}a${{ b }}",
+		},
+	}
+
+	sut := celplate.NewScanner(partialEvaluator{varsEvaluator{
+		"known":     "a",
+		"unknown":   nil,
+		"delimiter": "${{ x }}",
+		"yes":       true,
+		"no":        false,
+		"list":      []string{"x", "y"},
+	}})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := sut.TransformPartial([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestScanner_TransformPartial_UnsupportedEvaluator(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{})
+
+	_, err := sut.TransformPartial([]byte("${{ x }}"))
+
+	assert.EqualError(t, err, "the evaluator does not support partial evaluation")
+}
+
+func TestScanner_TransformPartial_MaxOutputSize(t *testing.T) {
+	sut := celplate.NewScanner(partialEvaluator{varsEvaluator{"unknown": nil}}, celplate.WithMaxOutputSize(10))
+
+	_, err := sut.TransformPartial([]byte("${{ unknown }}"))
+
+	assert.EqualError(t, err, "line 1, column 1 to line 1, column 15: output exceeds the limit of 10 bytes")
+}
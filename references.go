@@ -0,0 +1,114 @@
+package celplate
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+// Reference is a variable, or a field of a variable, which a template refers
+// to, like inputs.region.
+type Reference struct {
+	// Path is the fully qualified path of the reference, with the name of the
+	// variable followed by the names of the selected fields, e.g.
+	// "inputs.region".
+	Path string
+
+	// Location is the location of the first character of the reference.
+	Location source.Location
+}
+
+// References parses the given template and returns its references, without
+// evaluating it, just like Template.References.
+func (s *Scanner) References(input []byte) ([]Reference, error) {
+	template, err := s.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.References(s.evaluator)
+}
+
+// References returns the references of all expressions of the template, in
+// every branch of conditional blocks and in the body of every loop, in the
+// order they appear in. References to loop and set variables are skipped, so
+// that only the variables the template needs from the evaluator are returned.
+//
+// The evaluator must be a ReferencingEvaluator.
+func (t *Template) References(evaluator Evaluator) ([]Reference, error) {
+	referencing, ok := evaluator.(ReferencingEvaluator)
+	if !ok {
+		return nil, errors.New("the evaluator does not support references")
+	}
+
+	collector := &referenceCollector{evaluator: referencing, errs: &source.Errors{}}
+	collector.collectAll(t.nodes, nil)
+
+	if err := collector.errs.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	return collector.references, nil
+}
+
+// referenceCollector gathers the references of nodes.
+type referenceCollector struct {
+	evaluator  ReferencingEvaluator
+	references []Reference
+	errs       *source.Errors
+}
+
+// collectAll gathers the references of the nodes of a block, skipping the
+// given local variables and the variables set in the block.
+func (c *referenceCollector) collectAll(nodes []Node, locals map[string]bool) {
+	locals = maps.Clone(locals)
+	if locals == nil {
+		locals = map[string]bool{}
+	}
+
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *ExpressionNode:
+			c.collect(n.Expression, n.ExpressionStart, source.Range{Start: n.Start, End: n.End}, locals)
+		case *IfNode:
+			for _, branch := range n.Branches {
+				c.collect(branch.Condition, branch.ConditionStart, argumentRange(branch.ConditionStart, branch.Condition), locals)
+				c.collectAll(branch.Nodes, locals)
+			}
+			c.collectAll(n.Else, locals)
+		case *ForNode:
+			c.collect(n.Collection, n.CollectionStart, argumentRange(n.CollectionStart, n.Collection), locals)
+
+			loop := maps.Clone(locals)
+			loop[n.Key], loop[n.Value] = true, true
+			c.collectAll(n.Nodes, loop)
+		case *IncludeNode:
+			c.collectAll(n.Nodes, locals)
+		case *SetNode:
+			c.collect(n.Value, n.ValueStart, argumentRange(n.ValueStart, n.Value), locals)
+			locals[n.Name] = true
+		}
+	}
+}
+
+// collect gathers the references of the expression starting at the given
+// location.
+func (c *referenceCollector) collect(expression string, start source.Location, rng source.Range, locals map[string]bool) {
+	references, err := c.evaluator.References(expression)
+	if err != nil {
+		pushEvaluatorError(c.errs, err, start, rng)
+		return
+	}
+
+	references = slices.DeleteFunc(references, func(ref Reference) bool {
+		variable, _, _ := strings.Cut(ref.Path, ".")
+		return locals[variable]
+	})
+
+	for _, ref := range references {
+		c.references = append(c.references, Reference{Path: ref.Path, Location: start.Nested(ref.Location)})
+	}
+}
@@ -0,0 +1,55 @@
+package celplate_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestScanner_References(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{}, celplate.WithIncludes(celplate.Includes{
+		FS: fstest.MapFS{"partial.yaml": {Data: []byte("${{ partial }}${{ item }}")}},
+	}))
+
+	references, err := sut.References([]byte(strings.Join([]string{
+		"${{ a }}${{ if b }}${{ c }}${{ else }}${{ d }}${{ end }}",
+		"${{ for key, item in e }}${{ key }}${{ item }}${{ include \"partial.yaml\" }}${{ end }}${{ item }}",
+		"${{ set f = g }}${{ f }}",
+	}, "\n")))
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Reference{
+		{Path: "a", Location: source.Location{Index: 4, Line: 1, Column: 5, Offset: 4, UTF16Column: 5}},
+		{Path: "b", Location: source.Location{Index: 15, Line: 1, Column: 16, Offset: 15, UTF16Column: 16}},
+		{Path: "c", Location: source.Location{Index: 23, Line: 1, Column: 24, Offset: 23, UTF16Column: 24}},
+		{Path: "d", Location: source.Location{Index: 42, Line: 1, Column: 43, Offset: 42, UTF16Column: 43}},
+		{Path: "e", Location: source.Location{Index: 78, Line: 2, Column: 22, Offset: 78, UTF16Column: 22}},
+		{Path: "partial", Location: source.Location{File: "partial.yaml", Index: 4, Line: 1, Column: 5, Offset: 4, UTF16Column: 5}},
+		{Path: "item", Location: source.Location{Index: 146, Line: 2, Column: 90, Offset: 146, UTF16Column: 90}},
+		{Path: "g", Location: source.Location{Index: 166, Line: 3, Column: 13, Offset: 166, UTF16Column: 13}},
+	}, references)
+}
+
+func TestScanner_References_Errors(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{})
+
+	_, err := sut.References([]byte("${{ a }}\n${{ if  }}${{ end }}"))
+	assert.EqualError(t, err, `line 2, column 1 to line 2, column 11: missing condition in "if" directive`)
+
+	_, err = sut.References([]byte("${{ a }}\n${{ }}"))
+	assert.EqualError(t, err, "line 2, column 1 to line 2, column 7: empty expression")
+}
+
+func TestScanner_References_UnsupportedEvaluator(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+
+	_, err := sut.References([]byte("${{ a }}"))
+
+	assert.EqualError(t, err, "the evaluator does not support references")
+}
@@ -2,20 +2,27 @@ package celplate
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"errors"
+	"io"
+	"strings"
 
 	"github.com/spacelift-io/celplate/source"
 )
 
+// Scanner transforms templates by evaluating expressions nested inside
+// supported blocks. It only holds the configuration, so a single Scanner can
+// be reused, including concurrently, as long as its Evaluator is safe for
+// concurrent use.
 type Scanner struct {
-	currentExpression      *bytes.Buffer
-	currentExpressionStart source.Location
-	output                 *bytes.Buffer
-
-	state    scannerState
-	location *source.Location
-
-	evaluator Evaluator
+	delimiters Delimiters
+	comments   Comments
+	includes   Includes
+	fileName   string
+	evaluator  Evaluator
+
+	// maxOutputSize is the maximum size of the output in bytes, if positive.
+	maxOutputSize int
 }
 
 // Evaluator evaluates expressions nested inside supported blocks (${{ ... }}).
@@ -25,174 +32,305 @@ type Evaluator interface {
 	Evaluate(expression string) (string, error)
 }
 
-type scannerState int
+// ValueEvaluator is an Evaluator which can also evaluate expressions to
+// values other than strings, which is required by block directives.
+type ValueEvaluator interface {
+	Evaluator
+
+	// EvaluateValue evaluates the given expression and returns its result as
+	// a native Go value, and an error, if any.
+	EvaluateValue(expression string) (any, error)
+}
+
+// ScopedEvaluator is an Evaluator which can evaluate expressions with
+// additional variables, which is required by loop blocks and set directives.
+type ScopedEvaluator interface {
+	Evaluator
+
+	// WithVariables returns an evaluator which can also access the given
+	// variables, replacing the values of existing variables of the same names.
+	WithVariables(vars map[string]any) (Evaluator, error)
+}
+
+// ContextEvaluator is a ValueEvaluator which can also evaluate expressions
+// with a context, so that long evaluations can be cancelled. It's used
+// whenever a template is transformed or executed with a context.
+type ContextEvaluator interface {
+	ValueEvaluator
+
+	// EvaluateContext works like Evaluate, but stops as soon as the context
+	// is done.
+	EvaluateContext(ctx context.Context, expression string) (string, error)
+
+	// EvaluateValueContext works like EvaluateValue, but stops as soon as the
+	// context is done.
+	EvaluateValueContext(ctx context.Context, expression string) (any, error)
+}
+
+// CheckingEvaluator is an Evaluator which can also check expressions without
+// evaluating them, which is required to check templates before any data is
+// available.
+type CheckingEvaluator interface {
+	Evaluator
+
+	// Check returns the syntax and type errors of the given expression, if
+	// any.
+	Check(expression string) error
+}
+
+// ValueType is the type of the value of an expression, as far as it's known
+// before evaluating it. Types other than the ones below are named by the
+// evaluator, e.g. "int".
+type ValueType string
 
 const (
-	dollarChar = '$'
-	openChar   = '{'
-	closeChar  = '}'
-
-	ssDefault scannerState = iota
-	ssDollar
-	ssOpenChar
-	ssExpression
-	ssCloseChar
+	// DynType is the type of values which are only known once evaluated.
+	DynType ValueType = "dyn"
+
+	BoolType ValueType = "bool"
+	ListType ValueType = "list"
+	MapType  ValueType = "map"
 )
 
-// NewScanner returns a new generic `Scanner` object.
-func NewScanner(evaluator Evaluator) *Scanner {
-	return &Scanner{
-		currentExpression: bytes.NewBuffer(nil),
-		output:            bytes.NewBuffer(nil),
-		state:             ssDefault,
-		evaluator:         evaluator,
-		location:          source.Start(),
+// TypeCheckingEvaluator is a CheckingEvaluator which can also tell the type
+// of the value of an expression, so that conditions and loop collections of
+// the wrong type can be reported before any data is available.
+type TypeCheckingEvaluator interface {
+	CheckingEvaluator
+
+	// CheckType works like Check, but it also returns the type of the value
+	// of the expression.
+	CheckType(expression string) (ValueType, error)
+}
+
+// ReferencingEvaluator is an Evaluator which can also find the variables an
+// expression refers to, which is required to list the references of
+// a template.
+type ReferencingEvaluator interface {
+	Evaluator
+
+	// References returns the references of the given expression, in the
+	// order they appear in, with locations relative to the expression.
+	References(expression string) ([]Reference, error)
+}
+
+// PartialEvaluator is an Evaluator which can also evaluate the parts of
+// expressions whose variables have values, leaving the rest for later, which
+// is required to render templates partially.
+type PartialEvaluator interface {
+	Evaluator
+
+	// Residual returns the expression left after evaluating its parts which
+	// can be evaluated, and true, if the expression refers to variables
+	// without values. Otherwise, it returns false, and the expression can be
+	// evaluated as a whole.
+	Residual(expression string) (string, bool, error)
+
+	// WithUnknowns returns an evaluator for which the given variables have no
+	// values, even if they had before.
+	WithUnknowns(names ...string) (Evaluator, error)
+}
+
+// Delimiters define the character sequences which open and close an
+// expression block.
+type Delimiters struct {
+	// Open is the sequence opening an expression block, e.g. "${{".
+	Open string
+
+	// Close is the sequence closing an expression block, e.g. "}}".
+	Close string
+
+	// Escape is an optional sequence which, when directly followed by Open,
+	// makes the scanner output Open literally instead of opening a block.
+	Escape string
+}
+
+// DefaultDelimiters are the delimiters used by the scanner unless configured
+// otherwise: ${{ ... }}, escaped as $${{.
+var DefaultDelimiters = Delimiters{Open: "${{", Close: "}}", Escape: "$"}
+
+// Option configures a Scanner.
+type Option func(*Scanner)
+
+// WithDelimiters makes the scanner use the given delimiters instead of the
+// DefaultDelimiters.
+func WithDelimiters(delimiters Delimiters) Option {
+	return func(s *Scanner) {
+		s.delimiters = delimiters
 	}
 }
 
-// Transform will transform a given byte slice by using the evaluator.
-// It will continue even if it encounters an error gathering all
-// errors and returning at the end of input.
-func (s *Scanner) Transform(input []byte) ([]byte, error) {
-	errs := &source.Errors{}
-	lines := bytes.Split(input, []byte("\n"))
-
-	for ix, line := range lines {
-		// If the line starts with a comment, we don't want to evaluate it.
-		// We currently only support comments starting with a hash (#).
-		trimmedLine := bytes.TrimSpace(line)
-		if bytes.HasPrefix(trimmedLine, []byte("#")) {
-			s.output.Write(line)
-			if ix != len(lines)-1 {
-				s.output.Write([]byte("\n"))
-				// Increment the line if it's a comment since we're skipping line evaluation
-				// This is to keep the line location correct
-				s.location.Advance('\n')
-			}
-			continue
-		}
-
-		for _, char := range string(line) {
-			if err := s.consumeWithError(char); err != nil {
-				errs.Push(err)
-			}
-		}
-
-		if ix != len(lines)-1 {
-			if err := s.consumeWithError('\n'); err != nil {
-				errs.Push(err)
-			}
-		}
-	}
-
-	if s.state != ssDefault {
-		errs.Push(&source.Error{
-			Location: *s.location,
-			Message:  "unexpected end of input",
-		})
+// WithFileName sets the name of the file the scanner transforms, which is
+// then included in the locations of errors.
+func WithFileName(name string) Option {
+	return func(s *Scanner) {
+		s.fileName = name
 	}
+}
 
-	if err := errs.ErrorOrNil(); err != nil {
-		return nil, err
+// WithMaxOutputSize limits the output of transformations to the given number
+// of bytes. Once the output would be over the limit, the rest of the template
+// is skipped, and the breach is reported as a source error at the part of the
+// template producing it.
+func WithMaxOutputSize(size int) Option {
+	return func(s *Scanner) {
+		s.maxOutputSize = size
 	}
-	return s.output.Bytes(), nil
 }
 
-func (s *Scanner) consumeWithError(char rune) error {
-	defer func() { s.location.Advance(char) }()
+func (d Delimiters) validate() error {
+	if d.Open == "" || d.Close == "" {
+		return errors.New("opening and closing delimiters must not be empty")
+	}
 
-	err := s.consume(char)
-	if err != nil {
-		s.state = ssDefault
-		s.currentExpression.Reset()
+	if strings.ContainsRune(d.Open+d.Close+d.Escape, '\n') {
+		return errors.New("delimiters must not contain line breaks")
 	}
 
-	return err
+	return nil
 }
 
-func (s *Scanner) consume(char rune) error {
-	switch s.state {
-	case ssDefault:
-		return s.onDefault(char)
-	case ssDollar:
-		return s.onDollar(char)
-	case ssOpenChar:
-		return s.onWaitOpen(char)
-	case ssExpression:
-		return s.onExpression(char)
-	case ssCloseChar:
-		return s.onWaitClose(char)
+// escapedOpen returns the escape sequence followed by the opening delimiter,
+// or an empty string if escaping is disabled.
+func (d Delimiters) escapedOpen() string {
+	if d.Escape == "" {
+		return ""
 	}
 
-	return fmt.Errorf("impossible to handle state %q", s.state)
+	return d.Escape + d.Open
 }
 
-func (s *Scanner) onDefault(char rune) (err error) {
-	if char == dollarChar {
-		s.state = ssDollar
-		s.currentExpressionStart = *s.location
-		return
+// NewScanner returns a new generic `Scanner` object.
+func NewScanner(evaluator Evaluator, opts ...Option) *Scanner {
+	s := &Scanner{
+		delimiters: DefaultDelimiters,
+		comments:   DefaultComments,
+		evaluator:  evaluator,
 	}
 
-	_, err = s.output.WriteRune(char)
-	return
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Transform will transform a given byte slice by using the evaluator.
+// It will continue even if it encounters an error gathering all
+// errors and returning at the end of input.
+func (s *Scanner) Transform(input []byte) ([]byte, error) {
+	return s.TransformContext(context.Background(), input)
 }
 
-func (s *Scanner) onDollar(char rune) (err error) {
-	if char == openChar {
-		s.state = ssOpenChar
-		return
+// TransformContext works like Transform, but it stops as soon as the context
+// is done, returning its error. Evaluations in progress are cancelled if the
+// evaluator is a ContextEvaluator.
+func (s *Scanner) TransformContext(ctx context.Context, input []byte) ([]byte, error) {
+	var output bytes.Buffer
+
+	if err := s.TransformStream(ctx, bytes.NewReader(input), &output); err != nil {
+		return nil, err
 	}
 
-	s.state = ssDefault
-	_, err = s.output.Write([]byte{dollarChar, byte(char)})
+	return output.Bytes(), nil
+}
 
-	return
+// TransformStream works like Transform, but it consumes the input from the
+// reader incrementally, and writes the output to the writer as it goes.
+//
+// Errors in the source are gathered until the end of input, while the
+// output produced so far is still written. Reading, writing and context
+// errors stop the transformation immediately.
+func (s *Scanner) TransformStream(ctx context.Context, r io.Reader, w io.Writer) error {
+	return s.transform(ctx, r, w, nil)
 }
 
-func (s *Scanner) onWaitOpen(char rune) (err error) {
-	if char == openChar {
-		s.state = ssExpression
-		return
+// transform transforms the input from the reader, recording the output in the
+// source map, if given.
+func (s *Scanner) transform(ctx context.Context, r io.Reader, w io.Writer, sourceMap *SourceMap) error {
+	errs := &source.Errors{}
+	executor := newExecutor(ctx, s.evaluator, w, errs)
+	executor.limit = s.outputLimit()
+	executor.sourceMap = sourceMap
+
+	if err := s.parse(ctx, r, []string{s.fileName}, errs, executor.execute); err != nil {
+		return err
 	}
 
-	s.state = ssDefault
-	_, err = s.output.Write([]byte{dollarChar, openChar, byte(char)})
+	if err := executor.flush(); err != nil {
+		return err
+	}
 
-	return
+	return errs.ErrorOrNil()
 }
 
-func (s *Scanner) onExpression(char rune) (err error) {
-	if char == closeChar {
-		s.state = ssCloseChar
-		return
+// Check parses the given template and checks all of its expressions using
+// the evaluator, without evaluating them and without producing any output.
+// Unlike Transform, it checks every branch of conditional blocks and the body
+// of every loop, with loop and set variables declared, but without values.
+//
+// The evaluator must be a CheckingEvaluator and, for templates using loops or
+// set directives, a ScopedEvaluator.
+func (s *Scanner) Check(input []byte) error {
+	if _, ok := s.evaluator.(CheckingEvaluator); !ok {
+		return errors.New("the evaluator does not support checking expressions")
 	}
 
-	_, err = s.currentExpression.WriteRune(char)
+	errs := &source.Errors{}
+	executor := newExecutor(context.Background(), s.evaluator, io.Discard, errs)
+	executor.check = true
+
+	if err := s.parse(context.Background(), bytes.NewReader(input), []string{s.fileName}, errs, executor.execute); err != nil {
+		return err
+	}
 
-	return
+	return errs.ErrorOrNil()
 }
 
-func (s *Scanner) onWaitClose(char rune) (err error) {
-	if char != closeChar {
-		return &source.Error{
-			Location: *s.location,
-			Message:  fmt.Sprintf("unexpected character %q, expected %q", char, closeChar),
-		}
+// Parse parses the given template without evaluating it. Any syntax errors
+// are returned as source errors.
+func (s *Scanner) Parse(input []byte) (*Template, error) {
+	template := &Template{}
+	errs := &source.Errors{}
+
+	if err := s.parse(context.Background(), bytes.NewReader(input), []string{s.fileName}, errs, template.append); err != nil {
+		return nil, err
+	}
+
+	if err := errs.ErrorOrNil(); err != nil {
+		return nil, err
 	}
 
-	var out string
-	if out, err = s.evaluator.Evaluate(s.currentExpression.String()); err != nil {
-		return &source.Error{
-			Location: *s.location,
-			Message:  err.Error(),
-		}
+	return template, nil
+}
+
+// outputLimit returns a new limit of the size of the output, or nil if the
+// output is unlimited.
+func (s *Scanner) outputLimit() *outputLimit {
+	if s.maxOutputSize <= 0 {
+		return nil
 	}
 
-	s.state = ssDefault
-	s.currentExpression.Reset()
+	return &outputLimit{max: s.maxOutputSize}
+}
+
+// parse parses the whole input using the scanner configuration. The input is
+// the last of the given files, which are the files being parsed in the order
+// they were included in.
+func (s *Scanner) parse(ctx context.Context, r io.Reader, files []string, errs *source.Errors, emit func(Node) error) error {
+	blocks := newBlockBuilder(errs, emit)
 
-	_, err = s.output.WriteString(out)
+	parser := newParser(s.delimiters, s.comments, errs, blocks.push)
+	parser.location.File = files[len(files)-1]
+
+	blocks.include = func(tag *ExpressionNode, name string) (Node, error) {
+		return s.include(ctx, tag, name, parser.expressionIndentation, files, errs)
+	}
+
+	if err := parser.parse(ctx, r); err != nil {
+		return err
+	}
 
-	return
+	blocks.finish()
+	return nil
 }
@@ -1,14 +1,22 @@
 package celplate_test
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
 	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
 )
 
 type mockEvaluator struct {
@@ -20,6 +28,19 @@ func (m *mockEvaluator) Evaluate(expression string) (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+func (m *mockEvaluator) EvaluateValue(expression string) (any, error) {
+	args := m.Called(expression)
+	return args.Get(0), args.Error(1)
+}
+
+// stringEvaluator is an evaluator which only supports evaluating expressions
+// to strings.
+type stringEvaluator func(expression string) (string, error)
+
+func (f stringEvaluator) Evaluate(expression string) (string, error) {
+	return f(expression)
+}
+
 func TestScanner_Transform_PlainText(t *testing.T) {
 	sut := celplate.NewScanner(new(mockEvaluator))
 	input := []byte("Hello, world!")
@@ -56,10 +77,54 @@ func TestScanner_Transform_ExpressionEvaluationError(t *testing.T) {
 
 	output, err := sut.Transform([]byte("Hello, ${{ world }}!"))
 
-	assert.EqualError(t, err, "line 1, column 19: error")
+	assert.EqualError(t, err, "line 1, column 8 to line 1, column 20: error")
+	assert.Equal(t, source.Range{
+		Start: source.Location{Index: 7, Line: 1, Column: 8, Offset: 7, UTF16Column: 8},
+		End:   source.Location{Index: 19, Line: 1, Column: 20, Offset: 19, UTF16Column: 20},
+	}, source.GetErrors(err)[0].Range)
 	assert.Nil(t, output)
 }
 
+func TestScanner_Transform_FileName(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("", errors.New("error"))
+	sut := celplate.NewScanner(ev, celplate.WithFileName("stacks/app.yaml"))
+
+	_, err := sut.Transform([]byte("Hello,\n${{ world }}!\n${{ world"))
+
+	assert.EqualError(t, err, "stacks/app.yaml: line 2, column 1 to line 2, column 13: error; stacks/app.yaml: line 3, column 10: unexpected end of input")
+	assert.Equal(t, "stacks/app.yaml", source.GetErrors(err)[0].Location.File)
+}
+
+func TestScanner_Transform_MultiByteErrorLocation(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("", errors.New("error"))
+	sut := celplate.NewScanner(ev)
+
+	_, err := sut.Transform([]byte("é\n😀 ${{ world }}"))
+
+	assert.Equal(t, source.Range{
+		Start: source.Location{Index: 4, Line: 2, Column: 3, Offset: 8, UTF16Column: 4},
+		End:   source.Location{Index: 16, Line: 2, Column: 15, Offset: 20, UTF16Column: 16},
+	}, source.GetErrors(err)[0].Range)
+}
+
+func TestScanner_Transform_NestedSourceErrors(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " a +\n b ").Return("", &source.Errors{Errs: []error{
+		&source.Error{Location: source.Location{Index: 1, Line: 1, Column: 2, Offset: 1, UTF16Column: 2}, Message: "first"},
+		&source.Error{Location: source.Location{Index: 6, Line: 2, Column: 2, Offset: 6, UTF16Column: 2}, Message: "second"},
+		errors.New("third"),
+	}})
+	ev.On("Evaluate", " c ").Return("", &source.Error{Location: source.Location{Index: 1, Line: 1, Column: 2, Offset: 1, UTF16Column: 2}, Message: "fourth"})
+	sut := celplate.NewScanner(ev)
+
+	_, err := sut.Transform([]byte("Hello, ${{ a +\n b }} ${{ c }}"))
+
+	assert.EqualError(t, err, "line 1, column 12 (within line 1, column 8 to line 2, column 6): first; line 2, column 2 (within line 1, column 8 to line 2, column 6): second; line 1, column 8 to line 2, column 6: third; line 2, column 11 (within line 2, column 7 to line 2, column 15): fourth")
+	assert.Equal(t, source.Location{Index: 16, Line: 2, Column: 2, Offset: 16, UTF16Column: 2}, source.GetErrors(err)[1].Location)
+}
+
 func TestScanner_Transform_ExpressionEvaluationSuccess(t *testing.T) {
 	ev := new(mockEvaluator)
 	ev.On("Evaluate", " world ").Return("world", nil)
@@ -70,3 +135,604 @@ func TestScanner_Transform_ExpressionEvaluationSuccess(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, []byte("Hello, world!"), output)
 }
+
+func TestScanner_Transform_Escape(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "escaped block",
+			input: "run: $${{ github.sha }}",
+			want:  "run: ${{ github.sha }}",
+		},
+		{
+			name:  "escaped block at the end of a line",
+			input: "run: $${{\nnext: line",
+			want:  "run: ${{\nnext: line",
+		},
+		{
+			name:  "escaped block at the end of input",
+			input: "run: $${{",
+			want:  "run: ${{",
+		},
+		{
+			name:  "escaped block next to an expression",
+			input: "$${{ github.ref }}-${{ world }}-$${{ github.sha }}",
+			want:  "${{ github.ref }}-world-${{ github.sha }}",
+		},
+		{
+			name:  "escaped block in a comment is not unescaped",
+			input: "# $${{ github.sha }}\nvalue: ${{ world }}",
+			want:  "# $${{ github.sha }}\nvalue: world",
+		},
+		{
+			name:  "additional dollar signs are kept",
+			input: "$$$${{ github.sha }}",
+			want:  "$$${{ github.sha }}",
+		},
+		{
+			name:  "double dollar sign without a block is kept",
+			input: "price: $$5 and $${ value }",
+			want:  "price: $$5 and $${ value }",
+		},
+		{
+			name:  "dangling dollar signs at the end of input are kept",
+			input: "price: $$",
+			want:  "price: $$",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := new(mockEvaluator)
+			ev.On("Evaluate", " world ").Return("world", nil)
+			sut := celplate.NewScanner(ev)
+
+			output, err := sut.Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestScanner_Transform_Unicode(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		want       string
+		delimiters celplate.Delimiters
+	}{
+		{
+			name:  "multi-byte characters after a dollar sign",
+			input: "$€ ${€ $${€ ${{ world }}€",
+			want:  "$€ ${€ $${€ world€",
+		},
+		{
+			name:  "invalid UTF-8 is kept intact",
+			input: "a\xffb $\xff ${\xff\n# \xe2\x82 ${{ world }}\n\xe2\x82",
+			want:  "a\xffb $\xff ${\xff\n# \xe2\x82 ${{ world }}\n\xe2\x82",
+		},
+		{
+			name:  "multi-byte delimiters",
+			input: "«« world » « world »",
+			want:  "« world » world",
+			delimiters: celplate.Delimiters{
+				Open:   "«",
+				Close:  "»",
+				Escape: "«",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := new(mockEvaluator)
+			ev.On("Evaluate", " world ").Return("world", nil)
+
+			var opts []celplate.Option
+			if tt.delimiters.Open != "" {
+				opts = append(opts, celplate.WithDelimiters(tt.delimiters))
+			}
+
+			output, err := celplate.NewScanner(ev, opts...).Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestScanner_Transform_LineEndings(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "CRLF line endings are kept",
+			input: "a: ${{ world }}\r\n# ${{ world }}\r\nb: ${{\r\nworld\r\n}}\r\n",
+			want:  "a: world\r\n# ${{ world }}\r\nb: world\r\n",
+		},
+		{
+			name:  "CRLF line endings are trimmed",
+			input: "a:\r\n  ${{- world -}}\r\n\r\nb",
+			want:  "a:worldb",
+		},
+		{
+			name:  "byte order mark is kept",
+			input: "\ufeff# ${{ world }}\r\na: ${{ world }}",
+			want:  "\ufeff# ${{ world }}\r\na: world",
+		},
+		{
+			name:  "byte order mark is only recognised at the start",
+			input: "${{ world }}\ufeff\n\ufeff# ${{ world }}",
+			want:  "world\ufeff\n\ufeff# world",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := celplate.NewScanner(stringEvaluator(func(expression string) (string, error) {
+				return strings.TrimSpace(expression), nil
+			}))
+
+			output, err := sut.Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func FuzzScanner_Transform_PlainText(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"plain text",
+		"$€ ${€ $$ }} } $$$",
+		"a\xffb\xe2\x82 $\xff",
+		"# comment }}\r\n\tindented  \n",
+		"€ \u00a0 \U0001F600\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	sut := celplate.NewScanner(nil)
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		if bytes.Contains(input, []byte(celplate.DefaultDelimiters.Open)) {
+			t.Skip("the input contains an expression")
+		}
+
+		output, err := sut.Transform(input)
+
+		require.NoError(t, err)
+		assert.Equal(t, string(input), string(output))
+	})
+}
+
+func TestScanner_Transform_EscapeKeepsLocation(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("", errors.New("error"))
+	sut := celplate.NewScanner(ev)
+
+	_, err := sut.Transform([]byte("$${{ a }}\n  $${{ b }} ${{ world }}"))
+
+	assert.EqualError(t, err, "line 2, column 13 to line 2, column 25: error")
+}
+
+func TestScanner_Transform_CustomDelimiters(t *testing.T) {
+	tests := []struct {
+		name       string
+		delimiters celplate.Delimiters
+		input      string
+		want       string
+	}{
+		{
+			name:       "double braces",
+			delimiters: celplate.Delimiters{Open: "{{", Close: "}}"},
+			input:      "Hello, {{ world }}! ${{ world }}",
+			want:       "Hello, world! $world",
+		},
+		{
+			name:       "percent tags",
+			delimiters: celplate.Delimiters{Open: "<%", Close: "%>"},
+			input:      "Hello, <% world %>!",
+			want:       "Hello, world!",
+		},
+		{
+			name:       "closing prefix inside an expression",
+			delimiters: celplate.Delimiters{Open: "<%", Close: "%>"},
+			input:      "<% 10 % 3 %>",
+			want:       "1",
+		},
+		{
+			name:       "square brackets",
+			delimiters: celplate.Delimiters{Open: "[[", Close: "]]"},
+			input:      "[a, b] [[ world ]] [x]",
+			want:       "[a, b] world [x]",
+		},
+		{
+			name:       "overlapping opening prefix",
+			delimiters: celplate.Delimiters{Open: "aab", Close: "baa"},
+			input:      "aaab world baa",
+			want:       "aworld",
+		},
+		{
+			name:       "multi-byte delimiters",
+			delimiters: celplate.Delimiters{Open: "«", Close: "»"},
+			input:      "« world » »",
+			want:       "world »",
+		},
+		{
+			name:       "custom escape",
+			delimiters: celplate.Delimiters{Open: "{{", Close: "}}", Escape: "\\"},
+			input:      "\\{{ world }} {{ world }} \\ {{ world }}",
+			want:       "{{ world }} world \\ world",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := new(mockEvaluator)
+			ev.On("Evaluate", " world ").Return("world", nil)
+			ev.On("Evaluate", " 10 % 3 ").Return("1", nil)
+			sut := celplate.NewScanner(ev, celplate.WithDelimiters(tt.delimiters))
+
+			output, err := sut.Transform([]byte(tt.input))
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+func TestScanner_Transform_CustomDelimitersLocation(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("", errors.New("error"))
+	sut := celplate.NewScanner(ev, celplate.WithDelimiters(celplate.Delimiters{Open: "<%", Close: "%>"}))
+
+	_, err := sut.Transform([]byte("first\n  <% world %>"))
+
+	assert.EqualError(t, err, "line 2, column 3 to line 2, column 14: error")
+}
+
+func TestScanner_Transform_InvalidDelimiters(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator), celplate.WithDelimiters(celplate.Delimiters{Open: "{{"}))
+
+	output, err := sut.Transform([]byte("Hello, world!"))
+
+	assert.EqualError(t, err, "opening and closing delimiters must not be empty")
+	assert.Nil(t, output)
+}
+
+func TestScanner_Transform_ExpressionLiterals(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		expression string
+	}{
+		{
+			name:       "map literal",
+			input:      "${{ {'a': 1}['a'] }}",
+			expression: " {'a': 1}['a'] ",
+		},
+		{
+			name:       "nested map literals",
+			input:      "${{ {'a': {'b': 1}}.a.b }}",
+			expression: " {'a': {'b': 1}}.a.b ",
+		},
+		{
+			name:       "single-quoted string",
+			input:      "${{ 'x}}y' }}",
+			expression: " 'x}}y' ",
+		},
+		{
+			name:       "double-quoted string with escaped quote",
+			input:      `${{ "x\"}}y" }}`,
+			expression: ` "x\"}}y" `,
+		},
+		{
+			name:       "empty strings",
+			input:      `${{ '' + "" }}`,
+			expression: ` '' + "" `,
+		},
+		{
+			name:       "triple-quoted string",
+			input:      "${{ '''x'}}'y''' }}",
+			expression: " '''x'}}'y''' ",
+		},
+		{
+			name:       "triple double-quoted string",
+			input:      `${{ """x""}}y""" }}`,
+			expression: ` """x""}}y""" `,
+		},
+		{
+			name:       "raw string does not escape",
+			input:      `${{ r'x\' + '}}' }}`,
+			expression: ` r'x\' + '}}' `,
+		},
+		{
+			name:       "raw bytes string",
+			input:      `${{ string(bR"\") + '}}' }}`,
+			expression: ` string(bR"\") + '}}' `,
+		},
+		{
+			name:       "identifier ending with r is not a raw prefix",
+			input:      `${{ bar['\''] + '}}' }}`,
+			expression: ` bar['\''] + '}}' `,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := new(mockEvaluator)
+			ev.On("Evaluate", tt.expression).Return("ok", nil)
+			sut := celplate.NewScanner(ev)
+
+			output, err := sut.Transform([]byte(tt.input + "!"))
+
+			require.NoError(t, err)
+			assert.Equal(t, "ok!", string(output))
+		})
+	}
+}
+
+func TestScanner_Transform_UnterminatedStringLiteral(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+
+	output, err := sut.Transform([]byte("Hello, ${{ 'world }}!"))
+
+	assert.EqualError(t, err, "line 1, column 22: unexpected end of input")
+	assert.Nil(t, output)
+}
+
+func TestScanner_TransformStream(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("world", nil)
+	sut := celplate.NewScanner(ev)
+	input := strings.Repeat("# ${{ comment }}\nHello, ${{ world }}!\n", 1000)
+	var output bytes.Buffer
+
+	err := sut.TransformStream(context.Background(), iotest.OneByteReader(strings.NewReader(input)), &output)
+
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("# ${{ comment }}\nHello, world!\n", 1000), output.String())
+}
+
+func TestScanner_TransformStream_SourceErrors(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("world", nil)
+	ev.On("Evaluate", " error ").Return("", errors.New("error"))
+	sut := celplate.NewScanner(ev)
+	var output bytes.Buffer
+
+	err := sut.TransformStream(
+		context.Background(),
+		strings.NewReader("${{ error }}\n# comment\nHello, ${{ world }}!\n  ${{ error }}"),
+		&output,
+	)
+
+	assert.EqualError(t, err, "line 1, column 1 to line 1, column 13: error; line 4, column 3 to line 4, column 15: error")
+	assert.Equal(t, "\n# comment\nHello, world!\n  ", output.String())
+}
+
+func TestScanner_TransformStream_ReadError(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+
+	err := sut.TransformStream(context.Background(), iotest.ErrReader(errors.New("read error")), new(bytes.Buffer))
+
+	assert.EqualError(t, err, "read error")
+}
+
+func TestScanner_TransformStream_WriteError(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+	input := strings.Repeat("Hello, world!\n", 1000)
+
+	err := sut.TransformStream(context.Background(), strings.NewReader(input), failingWriter{})
+
+	assert.EqualError(t, err, "write error")
+}
+
+func TestScanner_TransformStream_ContextCancelled(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := sut.TransformStream(ctx, strings.NewReader("Hello, world!"), new(bytes.Buffer))
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// cancellingEvaluator cancels the context while evaluating an expression,
+// like a deadline reached in the middle of an evaluation.
+type cancellingEvaluator struct {
+	varsEvaluator
+	cancel context.CancelFunc
+}
+
+func (c cancellingEvaluator) EvaluateContext(ctx context.Context, _ string) (string, error) {
+	c.cancel()
+	return "", ctx.Err()
+}
+
+func (c cancellingEvaluator) EvaluateValueContext(ctx context.Context, _ string) (any, error) {
+	c.cancel()
+	return nil, ctx.Err()
+}
+
+func TestScanner_TransformContext_CancelledEvaluation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sut := celplate.NewScanner(cancellingEvaluator{varsEvaluator{"x": "x"}, cancel})
+
+	_, err := sut.TransformContext(ctx, []byte("a ${{ x }} b"))
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, source.GetErrors(err))
+}
+
+func TestTemplate_ExecuteContext_CancelledEvaluation(t *testing.T) {
+	template, err := celplate.Parse([]byte("${{ if x }}a${{ end }}"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = template.ExecuteContext(ctx, cancellingEvaluator{varsEvaluator{"x": true}, cancel})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestScanner_Transform_MaxOutputSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		size    int
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "within limit",
+			input: "Hello, ${{ x }}!",
+			size:  13,
+			want:  "Hello, world!",
+		},
+		{
+			name:    "expression over limit",
+			input:   "Hello, ${{ x }}!",
+			size:    11,
+			wantErr: "line 1, column 8 to line 1, column 16: output exceeds the limit of 11 bytes",
+		},
+		{
+			name:    "rest of template skipped",
+			input:   "${{ x }}\n${{ x }}\n${{ missing }}",
+			size:    10,
+			wantErr: "line 2, column 1 to line 2, column 9: output exceeds the limit of 10 bytes",
+		},
+		{
+			name:  "re-indented partial",
+			input: "stack:\n  ${{ include \"a.yaml\" }}",
+			size:  20,
+			want:  "stack:\n  a: 1\n  b: 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := celplate.NewScanner(varsEvaluator{"x": "world"},
+				celplate.WithMaxOutputSize(tt.size),
+				celplate.WithIncludes(celplate.Includes{
+					FS:     fstest.MapFS{"a.yaml": {Data: []byte("a: 1\nb: 2")}},
+					Indent: true,
+				}),
+			)
+
+			output, err := sut.Transform([]byte(tt.input))
+
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(output))
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write error")
+}
+
+func TestScanner_Transform_Reusable(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("world", nil)
+	ev.On("Evaluate", " error ").Return("", errors.New("error"))
+	sut := celplate.NewScanner(ev)
+
+	for range 3 {
+		output, err := sut.Transform([]byte("Hello, ${{ world }}!"))
+		require.NoError(t, err)
+		assert.Equal(t, "Hello, world!", string(output))
+
+		_, err = sut.Transform([]byte("Hello,\n${{ error }}"))
+		assert.EqualError(t, err, "line 2, column 1 to line 2, column 13: error")
+
+		_, err = sut.Transform([]byte("Hello, ${{ world"))
+		assert.EqualError(t, err, "line 1, column 17: unexpected end of input")
+	}
+}
+
+func TestScanner_Transform_Concurrent(t *testing.T) {
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("world", nil)
+	ev.On("Evaluate", " error ").Return("", errors.New("error"))
+	sut := celplate.NewScanner(ev)
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lines := strings.Repeat("Hello, ${{ world }}!\n", i)
+
+			output, err := sut.Transform([]byte(lines + "${{ error }}"))
+			assert.EqualError(t, err, fmt.Sprintf("line %d, column 1 to line %d, column 13: error", i+1, i+1))
+			assert.Nil(t, output)
+
+			output, err = sut.Transform([]byte(lines))
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Repeat("Hello, world!\n", i), string(output))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestScanner_Check(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"list": nil, "yes": nil, "x": nil})
+
+	err := sut.Check([]byte(strings.Join([]string{
+		"${{ if yes }}${{ x }}${{ else if no }}${{ y }}${{ else }}${{ z }}${{ end }}",
+		"${{ for key, item in list }}${{ key }}${{ item }}${{ end }}${{ item }}",
+		"${{ set a = x }}${{ a }}${{ set b = c }}${{ b }}",
+	}, "\n")))
+
+	assert.EqualError(t, err, strings.Join([]string{
+		`line 1, column 34 to line 1, column 36: unknown variable "no"`,
+		`line 1, column 39 to line 1, column 47: unknown variable "y"`,
+		`line 1, column 58 to line 1, column 66: unknown variable "z"`,
+		`line 2, column 60 to line 2, column 71: unknown variable "item"`,
+		`line 3, column 37 to line 3, column 38: unknown variable "c"`,
+	}, "; "))
+}
+
+func TestScanner_Check_Types(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"yes": true, "one": 1, "list": []string{"a"}, "text": "a", "x": nil})
+
+	err := sut.Check([]byte(strings.Join([]string{
+		"${{ if yes }}${{ else if one }}${{ else if x }}${{ end }}",
+		"${{ for item in list }}${{ end }}${{ for item in text }}${{ end }}${{ for item in x }}${{ end }}",
+	}, "\n")))
+
+	assert.EqualError(t, err, strings.Join([]string{
+		"line 1, column 26 to line 1, column 29: condition must evaluate to a bool, got int",
+		"line 2, column 50 to line 2, column 54: for loop collection must evaluate to a list or a map, got string",
+	}, "; "))
+}
+
+func TestScanner_Check_NoErrors(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"x": nil})
+
+	assert.NoError(t, sut.Check([]byte("text ${{ x }}")))
+}
+
+func TestScanner_Check_UnsupportedEvaluator(t *testing.T) {
+	sut := celplate.NewScanner(new(mockEvaluator))
+
+	err := sut.Check([]byte("${{ x }}"))
+
+	assert.EqualError(t, err, "the evaluator does not support checking expressions")
+}
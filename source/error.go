@@ -7,9 +7,31 @@ import (
 // Error represents an error in the source code at a given location.
 type Error struct {
 	Location Location
-	Message  string
+
+	// Range is an optional part of the source code the error relates to, like
+	// a whole expression block. The location is usually its start, but it may
+	// also point at the exact position of the error within the range.
+	Range Range
+
+	Message string
+
+	// Err is an optional underlying error, like a typed error returned by an
+	// evaluator, which can be inspected with errors.As.
+	Err error
 }
 
 func (l *Error) Error() string {
-	return fmt.Sprintf("%s: %s", l.Location.String(), l.Message)
+	switch {
+	case l.Range.IsZero():
+		return fmt.Sprintf("%s: %s", l.Location.String(), l.Message)
+	case l.Range.Start == l.Location:
+		return fmt.Sprintf("%s: %s", l.Range.String(), l.Message)
+	default:
+		return fmt.Sprintf("%s (within %s): %s", l.Location.String(), l.Range.String(), l.Message)
+	}
+}
+
+// Unwrap returns the underlying error, if any.
+func (l *Error) Unwrap() error {
+	return l.Err
 }
@@ -10,11 +10,18 @@ type Errors struct {
 	Errs []error
 }
 
+// Push adds the error to the collection. Collections of errors, e.g. of other
+// files, are merged into this one.
 func (e *Errors) Push(err error) {
 	if err == nil {
 		return
 	}
 
+	if errs, ok := err.(*Errors); ok {
+		e.Errs = append(e.Errs, errs.Errs...)
+		return
+	}
+
 	e.Errs = append(e.Errs, err)
 }
 
@@ -39,6 +46,11 @@ func (e *Errors) Error() string {
 	return strings.Join(parts, "; ")
 }
 
+// Unwrap returns the errors in the collection.
+func (e *Errors) Unwrap() []error {
+	return e.Errs
+}
+
 func GetErrors(err error) []*Error {
 	result := []*Error{}
 
@@ -29,3 +29,50 @@ func TestErrors(t *testing.T) {
 	assert.Equal(t, serr1, result[0])
 	assert.Equal(t, serr2, result[1])
 }
+
+func TestError_Range(t *testing.T) {
+	rng := source.Range{
+		Start: source.Location{Index: 2, Line: 1, Column: 3},
+		End:   source.Location{Index: 12, Line: 2, Column: 4},
+	}
+
+	sut := &source.Error{Location: rng.Start, Range: rng, Message: "foo"}
+	assert.Equal(t, "line 1, column 3 to line 2, column 4: foo", sut.Error())
+
+	sut = &source.Error{Location: source.Location{Index: 9, Line: 2, Column: 1}, Range: rng, Message: "bar"}
+	assert.Equal(t, "line 2, column 1 (within line 1, column 3 to line 2, column 4): bar", sut.Error())
+
+	result := source.GetErrors(&source.Errors{Errs: []error{sut}})
+	require.Len(t, result, 1)
+	assert.Equal(t, rng, result[0].Range)
+}
+
+func TestErrors_MultipleFiles(t *testing.T) {
+	first := &source.Errors{}
+	first.Push(&source.Error{Location: source.Location{File: "a.yaml", Line: 1, Column: 2}, Message: "foo"})
+
+	second := &source.Errors{}
+	second.Push(&source.Error{Location: source.Location{File: "b.yaml", Line: 3, Column: 4}, Message: "bar"})
+
+	sut := &source.Errors{}
+	sut.Push(first.ErrorOrNil())
+	sut.Push(second.ErrorOrNil())
+	sut.Push((&source.Errors{}).ErrorOrNil())
+
+	assert.Equal(t, "a.yaml: line 1, column 2: foo; b.yaml: line 3, column 4: bar", sut.Error())
+	assert.Len(t, source.GetErrors(sut), 2)
+
+	var src *source.Error
+	require.ErrorAs(t, sut, &src)
+	assert.Equal(t, "a.yaml", src.Location.File)
+}
+
+func TestError_Unwrap(t *testing.T) {
+	cause := errors.New("cause")
+
+	sut := &source.Errors{}
+	sut.Push(&source.Error{Location: source.Location{Line: 1, Column: 1}, Message: "foo", Err: cause})
+
+	assert.Equal(t, "line 1, column 1: foo", sut.Error())
+	assert.ErrorIs(t, sut, cause)
+}
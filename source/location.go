@@ -2,45 +2,151 @@ package source
 
 import (
 	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
-const lineBreak = '\n'
+const (
+	lineBreak = '\n'
+	crlf      = "\r\n"
+)
 
 // Location represents a location in the source code.
 type Location struct {
-	Index  int
+	// File is the name of the file the location is in. It's empty for the
+	// main input, unless it was given a name.
+	File string
+
+	// Index is the number of characters preceding the location.
+	Index int
+
+	// Line and Column are 1-based, with columns counted in characters.
 	Line   int
 	Column int
+
+	// Offset is the number of bytes preceding the location, which can be used
+	// to slice the source.
+	Offset int
+
+	// UTF16Column is the 1-based column counted in UTF-16 code units, as
+	// expected by editors implementing the Language Server Protocol.
+	UTF16Column int
 }
 
 // Start creates a new starting location.
 func Start() *Location {
-	return &Location{Line: 1, Column: 1}
+	return &Location{Line: 1, Column: 1, UTF16Column: 1}
 }
 
 // Advance advances the location based on a single character.
 func (l *Location) Advance(char rune) {
+	size := utf8.RuneLen(char)
+	if size < 0 {
+		size = 1
+	}
+
+	l.advance(char, size)
+}
+
+// AdvanceString advances the location based on the given text. Bytes which
+// are not valid UTF-8 are counted as single characters, and a carriage return
+// followed by a line feed is a single line break.
+func (l *Location) AdvanceString(text string) {
+	for len(text) > 0 {
+		text = text[l.advanceNext(text):]
+	}
+}
+
+// advanceNext advances the location based on the first character of the text,
+// and returns its size in bytes.
+func (l *Location) advanceNext(text string) int {
+	if strings.HasPrefix(text, crlf) {
+		l.Index++
+		l.advance(lineBreak, len(crlf))
+		return len(crlf)
+	}
+
+	char, size := utf8.DecodeRuneInString(text)
+	l.advance(char, size)
+	return size
+}
+
+func (l *Location) advance(char rune, size int) {
 	l.Index++
+	l.Offset += size
 
 	if char != lineBreak {
 		l.Column++
+		l.UTF16Column += max(utf16.RuneLen(char), 1)
 		return
 	}
 
 	l.Line++
 	l.Column = 1
+	l.UTF16Column = 1
 }
 
 // Nested returns a new location that is nested within the current location.
+// Only the first line of the nested location starts at the current column,
+// while the following lines start at the beginning of a line.
 func (l *Location) Nested(nested Location) Location {
+	column, utf16Column := nested.Column, nested.UTF16Column
+	if nested.Line == 1 {
+		column = l.Column + nested.Column - 1
+		utf16Column = l.UTF16Column + nested.UTF16Column - 1
+	}
+
 	return Location{
-		Index:  l.Index + nested.Index,
-		Line:   l.Line + nested.Line - 1,
-		Column: l.Column + nested.Column - 1,
+		File:        l.File,
+		Index:       l.Index + nested.Index,
+		Line:        l.Line + nested.Line - 1,
+		Column:      column,
+		Offset:      l.Offset + nested.Offset,
+		UTF16Column: utf16Column,
 	}
 }
 
+// Locate returns the location of the given line and column, counted in
+// characters, within the text.
+func Locate(text string, line, column int) Location {
+	return locate(text, func(l *Location) bool {
+		return l.Line > line || (l.Line == line && l.Column >= column)
+	})
+}
+
+// LocateUTF16 returns the location of the given line and column, counted in
+// UTF-16 code units, within the text.
+func LocateUTF16(text string, line, utf16Column int) Location {
+	return locate(text, func(l *Location) bool {
+		return l.Line > line || (l.Line == line && l.UTF16Column >= utf16Column)
+	})
+}
+
+// LocateOffset returns the location of the given byte offset within the text.
+func LocateOffset(text string, offset int) Location {
+	return locate(text, func(l *Location) bool {
+		return l.Offset >= offset
+	})
+}
+
+// locate advances through the text until it reaches the location matching the
+// condition, or the end of the text.
+func locate(text string, reached func(*Location) bool) Location {
+	location := Start()
+
+	for len(text) > 0 && !reached(location) {
+		text = text[location.advanceNext(text):]
+	}
+
+	return *location
+}
+
 // String returns a string representation of the location.
 func (l *Location) String() string {
+	if l.File != "" {
+		return fmt.Sprintf("%s: line %v, column %v", l.File, l.Line, l.Column)
+	}
+
 	return fmt.Sprintf("line %v, column %v", l.Line, l.Column)
 }
@@ -28,8 +28,54 @@ func TestLocation_Advance_LineBreak(t *testing.T) {
 	assert.Equal(t, "line 2, column 1", sut.String())
 }
 
+func TestLocation_Advance_MultiByteCharacters(t *testing.T) {
+	sut := source.Start()
+	sut.AdvanceString("é😀\xffa")
+	assert.Equal(t, source.Location{Index: 4, Line: 1, Column: 5, Offset: 8, UTF16Column: 6}, *sut)
+
+	sut.Advance('😀')
+	assert.Equal(t, source.Location{Index: 5, Line: 1, Column: 6, Offset: 12, UTF16Column: 8}, *sut)
+
+	sut.AdvanceString("\n")
+	assert.Equal(t, source.Location{Index: 6, Line: 2, Column: 1, Offset: 13, UTF16Column: 1}, *sut)
+}
+
+func TestLocation_AdvanceString_CRLF(t *testing.T) {
+	sut := source.Start()
+	sut.AdvanceString("a\r\nb\r")
+	assert.Equal(t, source.Location{Index: 5, Line: 2, Column: 3, Offset: 5, UTF16Column: 3}, *sut)
+}
+
 func TestLocation_Nested(t *testing.T) {
-	sut := &source.Location{Index: 1, Line: 2, Column: 3}
-	nested := source.Location{Index: 1, Line: 2, Column: 3}
-	assert.Equal(t, source.Location{Index: 2, Line: 3, Column: 5}, sut.Nested(nested))
+	sut := &source.Location{Index: 1, Line: 2, Column: 3, Offset: 2, UTF16Column: 4}
+	nested := source.Location{Index: 1, Line: 1, Column: 3, Offset: 3, UTF16Column: 4}
+	assert.Equal(t, source.Location{Index: 2, Line: 2, Column: 5, Offset: 5, UTF16Column: 7}, sut.Nested(nested))
+}
+
+func TestLocation_Nested_FollowingLine(t *testing.T) {
+	sut := &source.Location{Index: 1, Line: 2, Column: 3, Offset: 2, UTF16Column: 4}
+	nested := source.Location{Index: 5, Line: 2, Column: 3, Offset: 6, UTF16Column: 4}
+	assert.Equal(t, source.Location{Index: 6, Line: 3, Column: 3, Offset: 8, UTF16Column: 4}, sut.Nested(nested))
+}
+
+func TestLocate(t *testing.T) {
+	text := "ab\ncde\nf"
+	assert.Equal(t, source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1}, source.Locate(text, 1, 1))
+	assert.Equal(t, source.Location{Index: 5, Line: 2, Column: 3, Offset: 5, UTF16Column: 3}, source.Locate(text, 2, 3))
+	assert.Equal(t, source.Location{Index: 7, Line: 3, Column: 1, Offset: 7, UTF16Column: 1}, source.Locate(text, 3, 1))
+}
+
+func TestLocate_Conversions(t *testing.T) {
+	text := "a\n😀é = b"
+	want := source.Location{Index: 4, Line: 2, Column: 3, Offset: 8, UTF16Column: 4}
+
+	assert.Equal(t, want, source.Locate(text, 2, 3))
+	assert.Equal(t, want, source.LocateUTF16(text, 2, 4))
+	assert.Equal(t, want, source.LocateOffset(text, 8))
+}
+
+func TestLocation_String_File(t *testing.T) {
+	sut := &source.Location{File: "partials/labels.yaml", Line: 2, Column: 3}
+	assert.Equal(t, "partials/labels.yaml: line 2, column 3", sut.String())
+	assert.Equal(t, "partials/labels.yaml", sut.Nested(source.Location{Line: 1, Column: 1}).File)
 }
@@ -0,0 +1,31 @@
+package source
+
+import (
+	"fmt"
+)
+
+// Range represents a part of the source code, from the location of its first
+// character to the location right after its last character.
+type Range struct {
+	Start Location
+	End   Location
+}
+
+// IsZero returns whether the range is unset.
+func (r Range) IsZero() bool {
+	return r == Range{}
+}
+
+// String returns a string representation of the range. The file name, if
+// any, is only mentioned once.
+func (r Range) String() string {
+	start, end := r.Start, r.End
+	if start.File == "" {
+		return fmt.Sprintf("%s to %s", start.String(), end.String())
+	}
+
+	file := start.File
+	start.File, end.File = "", ""
+
+	return fmt.Sprintf("%s: %s to %s", file, start.String(), end.String())
+}
@@ -0,0 +1,32 @@
+package source_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestRange_String(t *testing.T) {
+	sut := source.Range{
+		Start: source.Location{Index: 2, Line: 1, Column: 3},
+		End:   source.Location{Index: 12, Line: 2, Column: 4},
+	}
+
+	assert.Equal(t, "line 1, column 3 to line 2, column 4", sut.String())
+}
+
+func TestRange_IsZero(t *testing.T) {
+	assert.True(t, source.Range{}.IsZero())
+	assert.False(t, source.Range{End: source.Location{Line: 1, Column: 1}}.IsZero())
+}
+
+func TestRange_String_File(t *testing.T) {
+	sut := source.Range{
+		Start: source.Location{File: "a.yaml", Index: 2, Line: 1, Column: 3},
+		End:   source.Location{File: "a.yaml", Index: 12, Line: 2, Column: 4},
+	}
+
+	assert.Equal(t, "a.yaml: line 1, column 3 to line 2, column 4", sut.String())
+}
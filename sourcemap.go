@@ -0,0 +1,186 @@
+package celplate
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+// SourceMap maps the output of a transformation back to the template, so
+// that problems found in the output, e.g. when it's parsed as YAML, can be
+// reported at the parts of the template which produced them.
+type SourceMap struct {
+	// Segments are the consecutive parts of the output, in order.
+	Segments []Segment
+
+	output []byte
+}
+
+// Segment is a part of the output produced by a single part of the template.
+type Segment struct {
+	// Start and End are the byte offsets of the segment in the output, the
+	// end being exclusive.
+	Start, End int
+
+	// Range is the part of the template which produced the segment, like
+	// a segment of text or a whole expression block.
+	Range source.Range
+
+	// Expression is the expression whose result is the segment, if any.
+	Expression string
+
+	// Verbatim is set when the segment is text copied from the template as
+	// is, so that every byte of it maps to its own location.
+	Verbatim bool
+}
+
+// TransformWithSourceMap works like Transform, but it also returns a source
+// map of the output.
+func (s *Scanner) TransformWithSourceMap(input []byte) ([]byte, *SourceMap, error) {
+	var output bytes.Buffer
+
+	sourceMap := &SourceMap{}
+	if err := s.transform(context.Background(), bytes.NewReader(input), &output, sourceMap); err != nil {
+		return nil, nil, err
+	}
+
+	sourceMap.output = output.Bytes()
+
+	return output.Bytes(), sourceMap, nil
+}
+
+// Lookup returns the location in the template of the byte at the given
+// offset of the output. Bytes of verbatim segments map to their own
+// locations, while bytes of other segments map to the start of their
+// ranges, e.g. to the start of an expression block. The end of the output
+// maps to the end of its last segment, and offsets outside of the output
+// map to a zero location.
+func (m *SourceMap) Lookup(offset int) source.Location {
+	segment, ok := m.SegmentAt(offset)
+	if !ok {
+		if last := len(m.Segments) - 1; last >= 0 && offset == m.Segments[last].End {
+			return m.end(m.Segments[last])
+		}
+
+		return source.Location{}
+	}
+
+	if !segment.Verbatim {
+		return segment.Range.Start
+	}
+
+	return advancedPast(segment.Range.Start, string(m.output[segment.Start:offset]))
+}
+
+// SegmentAt returns the segment containing the byte at the given offset of
+// the output, and whether there is one.
+func (m *SourceMap) SegmentAt(offset int) (Segment, bool) {
+	ix, found := slices.BinarySearchFunc(m.Segments, offset, func(segment Segment, offset int) int {
+		switch {
+		case segment.End <= offset:
+			return -1
+		case segment.Start > offset:
+			return 1
+		default:
+			return 0
+		}
+	})
+	if !found {
+		return Segment{}, false
+	}
+
+	return m.Segments[ix], true
+}
+
+// end returns the location in the template right after the segment.
+func (m *SourceMap) end(segment Segment) source.Location {
+	if !segment.Verbatim {
+		return segment.Range.Start
+	}
+
+	return segment.Range.End
+}
+
+// advancedPast returns the location right after the given text copied from
+// the template at the given location. Like in the parser, a byte order mark
+// at the start of the template doesn't take a column, and bytes within it map
+// to its start.
+func advancedPast(location source.Location, text string) source.Location {
+	if location.Offset != 0 {
+		return advancedBy(location, text)
+	}
+
+	if len(text) < len(byteOrderMark) && strings.HasPrefix(byteOrderMark, text) {
+		return location
+	}
+
+	if strings.HasPrefix(text, byteOrderMark) {
+		location.Offset += len(byteOrderMark)
+		text = text[len(byteOrderMark):]
+	}
+
+	return advancedBy(location, text)
+}
+
+// add appends a segment of the given size to the end of the output. It does
+// nothing if no source map is being produced.
+func (m *SourceMap) add(size int, segment Segment) {
+	if m == nil || size == 0 {
+		return
+	}
+
+	segment.Start = 0
+	if len(m.Segments) > 0 {
+		segment.Start = m.Segments[len(m.Segments)-1].End
+	}
+	segment.End = segment.Start + size
+
+	m.Segments = append(m.Segments, segment)
+}
+
+// addIndented appends the segments of the given partial text, re-indented
+// like indent does. Verbatim segments are split where indentation is
+// inserted, while the indentation itself maps to the given range of the
+// include directive.
+func (m *SourceMap) addIndented(partial *SourceMap, text, indentation string, rng source.Range) {
+	if m == nil {
+		return
+	}
+
+	// Offsets of the text where indentation is inserted.
+	var indents []int
+
+	offset := 0
+	for ix, line := range strings.SplitAfter(text, "\n") {
+		if ix > 0 && strings.TrimSpace(line) != "" {
+			indents = append(indents, offset)
+		}
+		offset += len(line)
+	}
+
+	for _, segment := range partial.Segments {
+		for segment.Start < segment.End {
+			for len(indents) > 0 && indents[0] <= segment.Start {
+				m.add(len(indentation), Segment{Range: rng})
+				indents = indents[1:]
+			}
+
+			end := segment.End
+			if len(indents) > 0 && indents[0] < end {
+				end = indents[0]
+			}
+
+			piece := segment
+			if segment.Verbatim {
+				piece.Range.End = advancedPast(segment.Range.Start, text[segment.Start:end])
+				segment.Range.Start = piece.Range.End
+			}
+
+			m.add(end-segment.Start, piece)
+			segment.Start = end
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package celplate_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestScanner_TransformWithSourceMap(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"world": "earth"})
+
+	output, sourceMap, err := sut.TransformWithSourceMap([]byte("Hi ${{ world }}!\n€ $${{ x }}"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "Hi earth!\n€ ${{ x }}", string(output))
+	assert.Equal(t, []celplate.Segment{
+		{
+			Start:    0,
+			End:      3,
+			Range:    source.Range{Start: source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1}, End: source.Location{Index: 3, Line: 1, Column: 4, Offset: 3, UTF16Column: 4}},
+			Verbatim: true,
+		},
+		{
+			Start:      3,
+			End:        8,
+			Range:      source.Range{Start: source.Location{Index: 3, Line: 1, Column: 4, Offset: 3, UTF16Column: 4}, End: source.Location{Index: 15, Line: 1, Column: 16, Offset: 15, UTF16Column: 16}},
+			Expression: "world",
+		},
+		{
+			Start:    8,
+			End:      9,
+			Range:    source.Range{Start: source.Location{Index: 15, Line: 1, Column: 16, Offset: 15, UTF16Column: 16}, End: source.Location{Index: 16, Line: 1, Column: 17, Offset: 16, UTF16Column: 17}},
+			Verbatim: true,
+		},
+		{
+			Start: 9,
+			End:   22,
+			Range: source.Range{Start: source.Location{Index: 16, Line: 1, Column: 17, Offset: 16, UTF16Column: 17}, End: source.Location{Index: 28, Line: 2, Column: 12, Offset: 30, UTF16Column: 12}},
+		},
+	}, sourceMap.Segments)
+
+	tests := []struct {
+		name   string
+		offset int
+		want   source.Location
+	}{
+		{
+			name:   "text",
+			offset: 1,
+			want:   source.Location{Index: 1, Line: 1, Column: 2, Offset: 1, UTF16Column: 2},
+		},
+		{
+			name:   "expression",
+			offset: 5,
+			want:   source.Location{Index: 3, Line: 1, Column: 4, Offset: 3, UTF16Column: 4},
+		},
+		{
+			name:   "text after expression",
+			offset: 8,
+			want:   source.Location{Index: 15, Line: 1, Column: 16, Offset: 15, UTF16Column: 16},
+		},
+		{
+			name:   "escaped text",
+			offset: 15,
+			want:   source.Location{Index: 16, Line: 1, Column: 17, Offset: 16, UTF16Column: 17},
+		},
+		{
+			name:   "end of output",
+			offset: 22,
+			want:   source.Location{Index: 16, Line: 1, Column: 17, Offset: 16, UTF16Column: 17},
+		},
+		{
+			name:   "outside of output",
+			offset: 23,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sourceMap.Lookup(tt.offset))
+		})
+	}
+}
+
+func TestScanner_TransformWithSourceMap_ByteOrderMark(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"y": "Y"})
+
+	output, sourceMap, err := sut.TransformWithSourceMap([]byte("\ufeffab ${{ y }}"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "\ufeffab Y", string(output))
+
+	// The byte order mark doesn't take a column.
+	assert.Equal(t, source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1}, sourceMap.Lookup(1))
+	assert.Equal(t, source.Location{Index: 0, Line: 1, Column: 1, Offset: 3, UTF16Column: 1}, sourceMap.Lookup(3))
+	assert.Equal(t, source.Location{Index: 2, Line: 1, Column: 3, Offset: 5, UTF16Column: 3}, sourceMap.Lookup(5))
+	assert.Equal(t, source.Location{Index: 3, Line: 1, Column: 4, Offset: 6, UTF16Column: 4}, sourceMap.Lookup(6))
+}
+
+func TestScanner_TransformWithSourceMap_Include(t *testing.T) {
+	sut := celplate.NewScanner(varsEvaluator{"x": "X"}, celplate.WithIncludes(celplate.Includes{
+		FS:     fstest.MapFS{"a.yaml": {Data: []byte("a: ${{ x }}\nb: 2\n")}},
+		Indent: true,
+	}))
+
+	output, sourceMap, err := sut.TransformWithSourceMap([]byte("stack:\n  ${{ include \"a.yaml\" }}"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "stack:\n  a: X\n  b: 2\n", string(output))
+
+	// Indentation maps to the include directive.
+	assert.Equal(t, source.Location{Index: 9, Line: 2, Column: 3, Offset: 9, UTF16Column: 3}, sourceMap.Lookup(15))
+
+	// Included text maps to the partial, past the indentation.
+	assert.Equal(t, source.Location{File: "a.yaml", Index: 13, Line: 2, Column: 2, Offset: 13, UTF16Column: 2}, sourceMap.Lookup(17))
+
+	// The end of the output maps to the end of the partial.
+	assert.Equal(t, source.Location{File: "a.yaml", Index: 17, Line: 3, Column: 1, Offset: 17, UTF16Column: 1}, sourceMap.Lookup(len(output)))
+
+	segment, ok := sourceMap.SegmentAt(12)
+	require.True(t, ok)
+	assert.Equal(t, "x", segment.Expression)
+	assert.Equal(t, "a.yaml", segment.Range.Start.File)
+}
+
+func TestScanner_TransformWithSourceMap_Errors(t *testing.T) {
+	output, sourceMap, err := celplate.NewScanner(varsEvaluator{}).TransformWithSourceMap([]byte("${{ missing }}"))
+
+	assert.EqualError(t, err, `line 1, column 1 to line 1, column 15: unknown variable "missing"`)
+	assert.Nil(t, output)
+	assert.Nil(t, sourceMap)
+}
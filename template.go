@@ -0,0 +1,903 @@
+package celplate
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spacelift-io/celplate/source"
+)
+
+// Template is a parsed template. Parsing happens only once, and the template
+// can then be executed any number of times, including concurrently.
+type Template struct {
+	nodes []Node
+}
+
+// Node is a part of a parsed template, either a *TextNode, an *ExpressionNode,
+// an *IfNode, a *ForNode, an *IncludeNode or a *SetNode.
+type Node interface {
+	node()
+}
+
+// TextNode is a segment of text, which is written out as is.
+type TextNode struct {
+	// Text is the text to write out. It may differ from the source, for
+	// example when it contains escape sequences.
+	Text string
+
+	// Source is the text as it appears in the source, including escape
+	// sequences. It's empty unless it differs from Text.
+	Source string
+
+	// Start is the location of the first character of the node, while End is
+	// the location right after its last character.
+	Start, End source.Location
+}
+
+// ExpressionNode is an expression block, which is replaced by the result of
+// evaluating its expression.
+type ExpressionNode struct {
+	// Expression is the expression nested inside the block, without the
+	// delimiters.
+	Expression string
+
+	// Start is the location of the opening delimiter, while End is the
+	// location right after the closing delimiter.
+	Start, End source.Location
+
+	// ExpressionStart is the location of the first character of Expression,
+	// which locations of errors within the expression are relative to.
+	ExpressionStart source.Location
+}
+
+// IfNode is a conditional block. It renders the nodes of the first branch
+// whose condition holds, or the else branch if none of them does.
+type IfNode struct {
+	// Branches are the "if" branch followed by any "else if" branches.
+	Branches []*IfBranch
+
+	// Else holds the nodes of the "else" branch. It's nil if there is none.
+	Else []Node
+
+	// Start is the location of the opening "if" directive, while End is the
+	// location right after the closing "end" directive.
+	Start, End source.Location
+}
+
+// IfBranch is a single branch of an IfNode.
+type IfBranch struct {
+	// Condition is the expression which must evaluate to true for the branch
+	// to be rendered.
+	Condition string
+
+	// Nodes are the contents of the branch.
+	Nodes []Node
+
+	// Start and End are the locations of the directive opening the branch,
+	// just like in an ExpressionNode.
+	Start, End source.Location
+
+	// ConditionStart is the location of the first character of Condition.
+	ConditionStart source.Location
+}
+
+// ForNode is a loop block. It renders its nodes once for every item of
+// a list or a map, with loop variables bound to the item.
+type ForNode struct {
+	// Key is the name of the variable bound to the index of a list item or
+	// to the key of a map item. It's empty if only one variable is declared.
+	Key string
+
+	// Value is the name of the variable bound to the item itself.
+	Value string
+
+	// Collection is the expression which must evaluate to a list or a map.
+	// Map items are iterated in the order of their keys.
+	Collection string
+
+	// CollectionStart is the location of the first character of Collection.
+	CollectionStart source.Location
+
+	// Nodes are the contents of the loop.
+	Nodes []Node
+
+	// Start is the location of the opening "for" directive, while End is the
+	// location right after the closing "end" directive.
+	Start, End source.Location
+}
+
+// IncludeNode is a partial template included from another file. It's rendered
+// in place of the include directive, with the same evaluator.
+type IncludeNode struct {
+	// File is the name of the included file.
+	File string
+
+	// Nodes are the contents of the included file.
+	Nodes []Node
+
+	// Indent is prepended to every line of the rendered partial but the first.
+	// It's empty unless partials are re-indented.
+	Indent string
+
+	// Start and End are the locations of the include directive, just like in
+	// an ExpressionNode.
+	Start, End source.Location
+}
+
+// SetNode is a set directive. It binds the value of an expression to
+// a variable, which is visible to the rest of the enclosing block.
+type SetNode struct {
+	// Name is the name of the variable.
+	Name string
+
+	// Value is the expression whose result is bound to the variable.
+	Value string
+
+	// ValueStart is the location of the first character of Value.
+	ValueStart source.Location
+
+	// Start and End are the locations of the directive, just like in an
+	// ExpressionNode.
+	Start, End source.Location
+}
+
+// source returns the text as it appears in the source.
+func (n *TextNode) source() string {
+	if n.Source != "" {
+		return n.Source
+	}
+
+	return n.Text
+}
+
+func (*TextNode) node()       {}
+func (*ExpressionNode) node() {}
+func (*IfNode) node()         {}
+func (*ForNode) node()        {}
+func (*IncludeNode) node()    {}
+func (*SetNode) node()        {}
+
+// Parse parses the given template using the given options. Any syntax errors
+// are returned as source errors.
+func Parse(input []byte, opts ...Option) (*Template, error) {
+	return NewScanner(nil, opts...).Parse(input)
+}
+
+// Nodes returns the nodes of the template, in order.
+func (t *Template) Nodes() []Node {
+	return t.nodes
+}
+
+// Execute evaluates the template using the evaluator, and returns its output.
+// It will continue even if it encounters an error gathering all errors and
+// returning them at the end.
+func (t *Template) Execute(evaluator Evaluator) ([]byte, error) {
+	return t.ExecuteContext(context.Background(), evaluator)
+}
+
+// ExecuteContext works like Execute, but it stops as soon as the context is
+// done, returning its error. Evaluations in progress are cancelled if the
+// evaluator is a ContextEvaluator.
+func (t *Template) ExecuteContext(ctx context.Context, evaluator Evaluator) ([]byte, error) {
+	var output bytes.Buffer
+
+	errs := &source.Errors{}
+	executor := newExecutor(ctx, evaluator, &output, errs)
+
+	for _, node := range t.nodes {
+		if err := executor.execute(node); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := executor.flush(); err != nil {
+		return nil, err
+	}
+
+	if err := errs.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
+}
+
+// Check checks all expressions of the template using the evaluator, without
+// evaluating them, just like Scanner.Check.
+func (t *Template) Check(evaluator Evaluator) error {
+	if _, ok := evaluator.(CheckingEvaluator); !ok {
+		return errors.New("the evaluator does not support checking expressions")
+	}
+
+	errs := &source.Errors{}
+	executor := newExecutor(context.Background(), evaluator, io.Discard, errs)
+	executor.check = true
+
+	for _, node := range t.nodes {
+		if err := executor.execute(node); err != nil {
+			return err
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// append adds the node to the template, merging adjacent text nodes.
+func (t *Template) append(node Node) error {
+	t.nodes = appendNode(t.nodes, node)
+	return nil
+}
+
+// executor writes out the result of executing nodes. Errors in the source
+// are gathered, while writing errors are returned.
+type executor struct {
+	ctx       context.Context
+	evaluator Evaluator
+	output    *bufio.Writer
+	errs      *source.Errors
+
+	// check is set when expressions are only checked, in which case every
+	// block is executed once and nothing is written out.
+	check bool
+
+	// partial is set when expressions referring to variables without values
+	// are written back, using the delimiters, instead of being evaluated.
+	partial    bool
+	delimiters Delimiters
+
+	// limit is the limit of the size of the output, if any. It's shared by
+	// the executors of nested blocks.
+	limit *outputLimit
+
+	// sourceMap records the parts of the template producing the output, if
+	// a source map was requested.
+	sourceMap *SourceMap
+
+	// unwrapped is the block being rendered partially without its
+	// directives, like an iteration of a loop, if any.
+	unwrapped *unwrappedBlock
+}
+
+// outputLimit tracks the size of the output against its maximum.
+type outputLimit struct {
+	max      int
+	written  int
+	exceeded bool
+}
+
+// Names of the limits reported by LimitError.
+const (
+	CostLimit             = "cost"
+	ExpressionLengthLimit = "expression length"
+	DepthLimit            = "depth"
+	ResultSizeLimit       = "result size"
+	OutputSizeLimit       = "output size"
+)
+
+// LimitError is returned when rendering breaches a limit, like the maximum
+// size of the output or a limit of the evaluator. Source errors of breaches
+// wrap it, so that it can be found with errors.As.
+type LimitError struct {
+	// Limit is the name of the breached limit, like OutputSizeLimit.
+	Limit string
+
+	// Value is the measured value breaching the limit, e.g. the length of an
+	// expression, or zero if it's unknown.
+	Value uint64
+
+	// Max is the maximum value allowed by the limit.
+	Max uint64
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case CostLimit:
+		return fmt.Sprintf("expression exceeds the cost limit of %d", e.Max)
+	case ExpressionLengthLimit:
+		return fmt.Sprintf("expression is %d characters long, exceeding the limit of %d characters", e.Value, e.Max)
+	case DepthLimit:
+		return fmt.Sprintf("expression is nested %d levels deep, exceeding the limit of %d levels", e.Value, e.Max)
+	case ResultSizeLimit:
+		return fmt.Sprintf("result is %d bytes long, exceeding the limit of %d bytes", e.Value, e.Max)
+	case OutputSizeLimit:
+		return fmt.Sprintf("output exceeds the limit of %d bytes", e.Max)
+	default:
+		return fmt.Sprintf("%s of %d exceeds the limit of %d", e.Limit, e.Value, e.Max)
+	}
+}
+
+func newExecutor(ctx context.Context, evaluator Evaluator, w io.Writer, errs *source.Errors) *executor {
+	return &executor{
+		ctx:       ctx,
+		evaluator: evaluator,
+		output:    bufio.NewWriter(w),
+		errs:      errs,
+	}
+}
+
+func (e *executor) execute(node Node) (err error) {
+	// Once the output is over its limit, the rest of the template is skipped.
+	if e.limit != nil && e.limit.exceeded {
+		return nil
+	}
+
+	switch n := node.(type) {
+	case *TextNode:
+		err = e.executeText(n)
+	case *ExpressionNode:
+		if e.check {
+			e.checkExpression(n.Expression, n.ExpressionStart, source.Range{Start: n.Start, End: n.End})
+			return nil
+		}
+
+		if e.partial {
+			if written, err := e.writeExpression(n); written || err != nil {
+				return err
+			}
+		}
+
+		rng := source.Range{Start: n.Start, End: n.End}
+
+		if out, evalErr := e.evaluate(n.Expression); evalErr != nil {
+			e.pushError(evalErr, n.ExpressionStart, rng)
+		} else {
+			err = e.write(e.escape(out), Segment{Range: rng, Expression: strings.TrimSpace(n.Expression)})
+		}
+	case *IfNode:
+		err = e.executeIf(n)
+	case *ForNode:
+		err = e.executeFor(n)
+	case *IncludeNode:
+		err = e.executeInclude(n)
+	case *SetNode:
+		err = e.executeSet(n)
+	default:
+		err = fmt.Errorf("impossible to execute node %T", node)
+	}
+
+	if err == nil {
+		err = e.ctx.Err()
+	}
+
+	return
+}
+
+// evaluate evaluates the expression, with the context of the executor if the
+// evaluator supports it.
+func (e *executor) evaluate(expression string) (string, error) {
+	if evaluator, ok := e.evaluator.(ContextEvaluator); ok {
+		return evaluator.EvaluateContext(e.ctx, expression)
+	}
+
+	return e.evaluator.Evaluate(expression)
+}
+
+// evaluateValue evaluates the expression to a value, with the context of the
+// executor if the evaluator supports it.
+func (e *executor) evaluateValue(evaluator ValueEvaluator, expression string) (any, error) {
+	if evaluator, ok := evaluator.(ContextEvaluator); ok {
+		return evaluator.EvaluateValueContext(e.ctx, expression)
+	}
+
+	return evaluator.EvaluateValue(expression)
+}
+
+// write writes the text produced by the part of the template described by
+// the segment, unless the output would be over its limit.
+func (e *executor) write(text string, segment Segment) error {
+	if !e.reserve(len(text), segment.Range) {
+		return nil
+	}
+
+	e.sourceMap.add(len(text), segment)
+
+	_, err := e.output.WriteString(text)
+	return err
+}
+
+// reserve counts the given number of bytes against the limit of the output,
+// and returns whether they are within it. Otherwise, the breach is reported
+// at the given range of the template.
+func (e *executor) reserve(size int, rng source.Range) bool {
+	if e.limit == nil {
+		return true
+	}
+
+	if e.limit.exceeded {
+		return false
+	}
+
+	e.limit.written += size
+
+	if e.limit.written > e.limit.max {
+		e.limit.exceeded = true
+		err := &LimitError{Limit: OutputSizeLimit, Value: uint64(e.limit.written), Max: uint64(e.limit.max)}
+		e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: err.Error(), Err: err})
+		return false
+	}
+
+	return true
+}
+
+func (e *executor) pushError(err error, start source.Location, rng source.Range) {
+	// Evaluations which were cancelled are not reported as source errors.
+	if e.ctx.Err() != nil {
+		return
+	}
+
+	pushEvaluatorError(e.errs, err, start, rng)
+}
+
+// pushEvaluatorError records an error returned by the evaluator for the given
+// range of the template. Source errors within the expression starting at the
+// given location are moved to their location in the template, while any other
+// error is reported at the start of the range.
+func pushEvaluatorError(target *source.Errors, err error, start source.Location, rng source.Range) {
+	errs := []error{err}
+
+	var nested *source.Errors
+	if errors.As(err, &nested) {
+		errs = nested.Errs
+	}
+
+	for _, err := range errs {
+		var src *source.Error
+		if !errors.As(err, &src) {
+			target.Push(&source.Error{Location: rng.Start, Range: rng, Message: err.Error(), Err: err})
+			continue
+		}
+
+		target.Push(&source.Error{
+			Location: start.Nested(src.Location),
+			Range:    rng,
+			Message:  src.Message,
+			Err:      src.Err,
+		})
+	}
+}
+
+// executeAll executes the nodes of a block. Variables set inside the block
+// are not visible outside of it.
+func (e *executor) executeAll(nodes []Node) error {
+	block := *e
+
+	for _, node := range nodes {
+		if err := block.execute(node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkExpression checks the expression starting at the given location,
+// and returns whether it's valid.
+func (e *executor) checkExpression(expression string, start source.Location, rng source.Range) bool {
+	_, ok := e.checkType(expression, start, rng)
+	return ok
+}
+
+// checkType checks the expression starting at the given location, and
+// returns the type of its value, which is dynamic unless the evaluator is
+// a TypeCheckingEvaluator. The second value is false if it's not valid.
+func (e *executor) checkType(expression string, start source.Location, rng source.Range) (ValueType, bool) {
+	evaluator, ok := e.evaluator.(CheckingEvaluator)
+	if !ok {
+		e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: "the evaluator does not support checking expressions"})
+		return "", false
+	}
+
+	typ := DynType
+
+	var err error
+	if typeChecking, ok := evaluator.(TypeCheckingEvaluator); ok {
+		typ, err = typeChecking.CheckType(expression)
+	} else {
+		err = evaluator.Check(expression)
+	}
+
+	if err != nil {
+		e.pushError(err, start, rng)
+		return "", false
+	}
+
+	return typ, true
+}
+
+func (e *executor) executeText(node *TextNode) error {
+	if e.check {
+		return nil
+	}
+
+	text := node.Text
+	if e.partial {
+		text = node.source()
+	}
+
+	// Text is verbatim unless escapes were removed from it, or it was merged
+	// with other text around something left out, like a comment.
+	return e.write(text, Segment{
+		Range:    source.Range{Start: node.Start, End: node.End},
+		Verbatim: text == node.source() && len(text) == node.End.Offset-node.Start.Offset,
+	})
+}
+
+func (e *executor) executeIf(node *IfNode) error {
+	if e.check {
+		return e.checkIf(node)
+	}
+
+	if e.partial {
+		return e.executePartialIf(node)
+	}
+
+	for _, branch := range node.Branches {
+		holds, ok := e.evaluateCondition(branch)
+		if !ok {
+			// Without knowing which branch to render, none of them is.
+			return nil
+		}
+
+		if holds {
+			return e.executeAll(branch.Nodes)
+		}
+	}
+
+	return e.executeAll(node.Else)
+}
+
+// checkIf checks the conditions and the contents of all branches.
+func (e *executor) checkIf(node *IfNode) error {
+	for _, branch := range node.Branches {
+		rng := argumentRange(branch.ConditionStart, branch.Condition)
+
+		if typ, ok := e.checkType(branch.Condition, branch.ConditionStart, rng); ok && typ != DynType && typ != BoolType {
+			e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: fmt.Sprintf("condition must evaluate to a bool, got %s", typ)})
+		}
+
+		if err := e.executeAll(branch.Nodes); err != nil {
+			return err
+		}
+	}
+
+	return e.executeAll(node.Else)
+}
+
+// evaluateCondition returns whether the condition of the branch holds, and
+// false as the second value if it could not be evaluated.
+func (e *executor) evaluateCondition(branch *IfBranch) (holds, ok bool) {
+	evaluator, ok := e.evaluator.(ValueEvaluator)
+	if !ok {
+		e.errs.Push(&source.Error{
+			Location: branch.Start,
+			Message:  "the evaluator does not support conditions",
+		})
+		return false, false
+	}
+
+	rng := argumentRange(branch.ConditionStart, branch.Condition)
+
+	value, err := e.evaluateValue(evaluator, branch.Condition)
+	if err != nil {
+		e.pushError(err, branch.ConditionStart, rng)
+		return false, false
+	}
+
+	if holds, ok = value.(bool); !ok {
+		e.errs.Push(&source.Error{
+			Location: rng.Start,
+			Range:    rng,
+			Message:  fmt.Sprintf("condition must evaluate to a bool, got %T", value),
+		})
+	}
+
+	return holds, ok
+}
+
+func (e *executor) executeFor(node *ForNode) error {
+	if e.check {
+		return e.checkFor(node)
+	}
+
+	if e.partial {
+		if written, err := e.writeFor(node); written || err != nil {
+			return err
+		}
+	}
+
+	valueEvaluator, ok := e.evaluator.(ValueEvaluator)
+	scopedEvaluator, scoped := e.evaluator.(ScopedEvaluator)
+	if !ok || !scoped {
+		e.errs.Push(&source.Error{
+			Location: node.Start,
+			Message:  "the evaluator does not support loops",
+		})
+		return nil
+	}
+
+	rng := argumentRange(node.CollectionStart, node.Collection)
+
+	collection, err := e.evaluateValue(valueEvaluator, node.Collection)
+	if err != nil {
+		e.pushError(err, node.CollectionStart, rng)
+		return nil
+	}
+
+	items, err := loopItems(collection)
+	if err != nil {
+		e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: err.Error()})
+		return nil
+	}
+
+	for _, item := range items {
+		vars := map[string]any{node.Value: item.value}
+		if node.Key != "" {
+			vars[node.Key] = item.key
+		}
+
+		evaluator, err := scopedEvaluator.WithVariables(vars)
+		if err != nil {
+			e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: err.Error()})
+			return nil
+		}
+
+		before := len(e.errs.Errs)
+		body := *e
+		body.evaluator = evaluator
+
+		if err := body.executeUnwrapped(node.Nodes, source.Range{Start: node.Start, End: node.End}); err != nil {
+			return err
+		}
+
+		// Errors inside the loop are annotated with the failing iteration.
+		for ix, err := range e.errs.Errs[before:] {
+			e.errs.Errs[before+ix] = item.annotate(err)
+		}
+	}
+
+	return nil
+}
+
+// checkFor checks the collection and the contents of the loop, with the loop
+// variables declared.
+func (e *executor) checkFor(node *ForNode) error {
+	rng := argumentRange(node.CollectionStart, node.Collection)
+
+	if typ, ok := e.checkType(node.Collection, node.CollectionStart, rng); ok && typ != DynType && typ != ListType && typ != MapType {
+		e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: fmt.Sprintf("for loop collection must evaluate to a list or a map, got %s", typ)})
+	}
+
+	vars := map[string]any{node.Value: nil}
+	if node.Key != "" {
+		vars[node.Key] = nil
+	}
+
+	body, ok := e.declare(vars, node.Start, rng)
+	if !ok {
+		return nil
+	}
+
+	return body.executeAll(node.Nodes)
+}
+
+// declare returns an executor whose evaluator also has the given variables.
+func (e *executor) declare(vars map[string]any, start source.Location, rng source.Range) (*executor, bool) {
+	scopedEvaluator, ok := e.evaluator.(ScopedEvaluator)
+	if !ok {
+		e.errs.Push(&source.Error{Location: start, Message: "the evaluator does not support variables"})
+		return nil, false
+	}
+
+	evaluator, err := scopedEvaluator.WithVariables(vars)
+	if err != nil {
+		e.errs.Push(&source.Error{Location: rng.Start, Range: rng, Message: err.Error()})
+		return nil, false
+	}
+
+	declared := *e
+	declared.evaluator = evaluator
+
+	return &declared, true
+}
+
+// executeSet makes the variable of the node visible to the nodes executed
+// after it.
+func (e *executor) executeSet(node *SetNode) error {
+	if e.check {
+		e.checkSet(node)
+		return nil
+	}
+
+	if e.partial {
+		if written, err := e.writeSet(node); written || err != nil {
+			return err
+		}
+	}
+
+	valueEvaluator, ok := e.evaluator.(ValueEvaluator)
+	_, scoped := e.evaluator.(ScopedEvaluator)
+	if !ok || !scoped {
+		e.errs.Push(&source.Error{
+			Location: node.Start,
+			Message:  "the evaluator does not support variables",
+		})
+		return nil
+	}
+
+	rng := argumentRange(node.ValueStart, node.Value)
+
+	value, err := e.evaluateValue(valueEvaluator, node.Value)
+	if err != nil {
+		e.pushError(err, node.ValueStart, rng)
+		return nil
+	}
+
+	if declared, ok := e.declare(map[string]any{node.Name: value}, node.Start, rng); ok {
+		e.evaluator = declared.evaluator
+	}
+
+	return nil
+}
+
+// checkSet checks the value of the node, and declares its variable for the
+// nodes checked after it.
+func (e *executor) checkSet(node *SetNode) {
+	rng := argumentRange(node.ValueStart, node.Value)
+	e.checkExpression(node.Value, node.ValueStart, rng)
+
+	if declared, ok := e.declare(map[string]any{node.Name: nil}, node.Start, rng); ok {
+		e.evaluator = declared.evaluator
+	}
+}
+
+func (e *executor) executeInclude(node *IncludeNode) error {
+	rng := source.Range{Start: node.Start, End: node.End}
+
+	if node.Indent == "" {
+		return e.executeUnwrapped(node.Nodes, rng)
+	}
+
+	var output bytes.Buffer
+	partial := *e
+	partial.output = bufio.NewWriter(&output)
+
+	if e.sourceMap != nil {
+		partial.sourceMap = &SourceMap{}
+	}
+
+	if err := partial.executeUnwrapped(node.Nodes, rng); err != nil {
+		return err
+	}
+
+	if err := partial.flush(); err != nil {
+		return err
+	}
+
+	text := output.String()
+	indented := indent(text, node.Indent)
+
+	// The output of the partial was counted as it was written, unlike the
+	// indentation.
+	if !e.reserve(len(indented)-len(text), rng) {
+		return nil
+	}
+
+	e.sourceMap.addIndented(partial.sourceMap, text, node.Indent, rng)
+
+	_, err := e.output.WriteString(indented)
+	return err
+}
+
+func (e *executor) flush() error {
+	return e.output.Flush()
+}
+
+// argumentRange returns the range of a directive argument, like a condition,
+// starting at the given location.
+func argumentRange(start source.Location, argument string) source.Range {
+	return source.Range{Start: start, End: advancedBy(start, argument)}
+}
+
+// loopItem is a single item of a collection iterated by a loop.
+type loopItem struct {
+	key   any
+	value any
+
+	// mapped is set for items of maps, as opposed to lists.
+	mapped bool
+}
+
+// annotate adds the description of the item to the error message.
+func (i loopItem) annotate(err error) error {
+	var sourceErr *source.Error
+	if !errors.As(err, &sourceErr) {
+		return err
+	}
+
+	position := fmt.Sprintf("index %d", i.key)
+	if i.mapped {
+		position = fmt.Sprintf("key %s", describeValue(i.key))
+	}
+
+	return &source.Error{
+		Location: sourceErr.Location,
+		Range:    sourceErr.Range,
+		Message:  fmt.Sprintf("for loop at %s: %s", position, sourceErr.Message),
+		Err:      sourceErr.Err,
+	}
+}
+
+// loopItems returns the items of a list or a map. Map items are sorted by
+// their keys, so that the output is deterministic.
+func loopItems(collection any) ([]loopItem, error) {
+	value := reflect.ValueOf(collection)
+
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		items := make([]loopItem, value.Len())
+		for ix := range items {
+			items[ix] = loopItem{key: ix, value: value.Index(ix).Interface()}
+		}
+		return items, nil
+
+	case reflect.Map:
+		items := make([]loopItem, 0, value.Len())
+		for it := value.MapRange(); it.Next(); {
+			items = append(items, loopItem{key: it.Key().Interface(), value: it.Value().Interface(), mapped: true})
+		}
+
+		slices.SortFunc(items, func(a, b loopItem) int { return compareKeys(a.key, b.key) })
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("for loop collection must evaluate to a list or a map, got %T", collection)
+}
+
+// compareKeys orders map keys: strings and numbers by their values, and any
+// other keys by their string representation.
+func compareKeys(a, b any) int {
+	if a, ok := a.(string); ok {
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	}
+
+	if a, ok := toFloat(a); ok {
+		if b, ok := toFloat(b); ok {
+			return cmp.Compare(a, b)
+		}
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(value any) (float64, bool) {
+	v := reflect.ValueOf(value)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+
+	return 0, false
+}
+
+func describeValue(value any) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,120 @@
+package celplate_test
+
+import (
+	"errors"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spacelift-io/celplate"
+	"github.com/spacelift-io/celplate/source"
+)
+
+func TestParse(t *testing.T) {
+	template, err := celplate.Parse([]byte("Hello,\n${{ world }}! $${{ x }}\n# ${{ y }}"))
+
+	require.NoError(t, err)
+	assert.Equal(t, []celplate.Node{
+		&celplate.TextNode{
+			Text:  "Hello,\n",
+			Start: source.Location{Index: 0, Line: 1, Column: 1, Offset: 0, UTF16Column: 1},
+			End:   source.Location{Index: 7, Line: 2, Column: 1, Offset: 7, UTF16Column: 1},
+		},
+		&celplate.ExpressionNode{
+			Expression:      " world ",
+			Start:           source.Location{Index: 7, Line: 2, Column: 1, Offset: 7, UTF16Column: 1},
+			End:             source.Location{Index: 19, Line: 2, Column: 13, Offset: 19, UTF16Column: 13},
+			ExpressionStart: source.Location{Index: 10, Line: 2, Column: 4, Offset: 10, UTF16Column: 4},
+		},
+		&celplate.TextNode{
+			Text:   "! ${{ x }}\n# ${{ y }}",
+			Source: "! $${{ x }}\n# ${{ y }}",
+			Start:  source.Location{Index: 19, Line: 2, Column: 13, Offset: 19, UTF16Column: 13},
+			End:    source.Location{Index: 41, Line: 3, Column: 11, Offset: 41, UTF16Column: 11},
+		},
+	}, template.Nodes())
+}
+
+func TestParse_CustomDelimiters(t *testing.T) {
+	template, err := celplate.Parse([]byte("<% world %>"), celplate.WithDelimiters(celplate.Delimiters{Open: "<%", Close: "%>"}))
+
+	require.NoError(t, err)
+	require.Len(t, template.Nodes(), 1)
+	assert.Equal(t, " world ", template.Nodes()[0].(*celplate.ExpressionNode).Expression)
+}
+
+func TestParse_SyntaxErrors(t *testing.T) {
+	template, err := celplate.Parse([]byte("Hello, ${{ world }!\n${{ world"))
+
+	assert.EqualError(t, err, "line 1, column 19: unexpected character '!', expected '}'; line 2, column 10: unexpected end of input")
+	assert.Nil(t, template)
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"Hello, ${{ world }}!",
+		"${{ if a }}${{ for x in y }}${{ x }}${{ end }}${{ else }}€${{ end }}",
+		"${{ '}}' + \"\"\"\n# \xff\"\"\" }} $${{ ${{- x -}}",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		template, err := celplate.Parse(input)
+		if err != nil {
+			assert.NotEmpty(t, source.GetErrors(err))
+			return
+		}
+
+		// Nodes follow each other and never point past the end of input.
+		previous := 0
+		for _, node := range template.Nodes() {
+			var start source.Location
+			switch n := node.(type) {
+			case *celplate.TextNode:
+				start = n.Start
+			case *celplate.ExpressionNode:
+				start = n.Start
+			case *celplate.IfNode:
+				start = n.Start
+			case *celplate.ForNode:
+				start = n.Start
+			}
+
+			assert.GreaterOrEqual(t, start.Index, previous)
+			previous = start.Index
+		}
+		assert.LessOrEqual(t, previous, utf8.RuneCount(input))
+	})
+}
+
+func TestTemplate_Execute(t *testing.T) {
+	template, err := celplate.Parse([]byte("Hello, ${{ world }}!"))
+	require.NoError(t, err)
+
+	for _, name := range []string{"world", "there"} {
+		ev := new(mockEvaluator)
+		ev.On("Evaluate", " world ").Return(name, nil)
+
+		output, err := template.Execute(ev)
+
+		require.NoError(t, err)
+		assert.Equal(t, "Hello, "+name+"!", string(output))
+	}
+}
+
+func TestTemplate_Execute_EvaluationErrors(t *testing.T) {
+	template, err := celplate.Parse([]byte("${{ error }}\nHello, ${{ world }}!\n${{ error }}"))
+	require.NoError(t, err)
+
+	ev := new(mockEvaluator)
+	ev.On("Evaluate", " world ").Return("world", nil)
+	ev.On("Evaluate", " error ").Return("", errors.New("error"))
+
+	output, err := template.Execute(ev)
+
+	assert.EqualError(t, err, "line 1, column 1 to line 1, column 13: error; line 3, column 1 to line 3, column 13: error")
+	assert.Nil(t, output)
+}